@@ -4,13 +4,13 @@ go 1.18
 
 require (
 	github.com/akrylysov/pogreb v0.10.1
+	github.com/bwmarrin/snowflake v0.3.0
 	github.com/stretchr/testify v1.7.1
 	github.com/syndtr/goleveldb v1.0.0
 	github.com/xujiajun/nutsdb v0.10.0
 )
 
 require (
-	github.com/bwmarrin/snowflake v0.3.0 // indirect
 	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
 	github.com/pkg/errors v0.9.1 // indirect
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// Backup archive of prefix based stores (leveldb, pogreb): gzip stream of
+// raw db entries (metadata and value envelopes included), each written as
+// uvarint key length, key, uvarint value length, value
+var archiveMagic = []byte("MYLSMDB1")
+
+type ArchiveWriter struct {
+	gz  *gzip.Writer
+	buf *bufio.Writer
+}
+
+func NewArchiveWriter(w io.Writer) (*ArchiveWriter, error) {
+	gz := gzip.NewWriter(w)
+
+	a := &ArchiveWriter{gz: gz, buf: bufio.NewWriter(gz)}
+	if _, err := a.buf.Write(archiveMagic); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *ArchiveWriter) Write(key, value []byte) error {
+	var size [binary.MaxVarintLen64]byte
+
+	for _, b := range [][]byte{key, value} {
+		n := binary.PutUvarint(size[:], uint64(len(b)))
+
+		if _, err := a.buf.Write(size[:n]); err != nil {
+			return err
+		}
+
+		if _, err := a.buf.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Flush all entries, the underlying writer is not closed
+func (a *ArchiveWriter) Close() error {
+	if err := a.buf.Flush(); err != nil {
+		return err
+	}
+
+	return a.gz.Close()
+}
+
+type ArchiveReader struct {
+	gz  *gzip.Reader
+	buf *bufio.Reader
+}
+
+func NewArchiveReader(r io.Reader) (*ArchiveReader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidArchive, err)
+	}
+
+	a := &ArchiveReader{gz: gz, buf: bufio.NewReader(gz)}
+
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(a.buf, magic); err != nil || !bytes.Equal(magic, archiveMagic) {
+		return nil, ErrInvalidArchive
+	}
+
+	return a, nil
+}
+
+// Next entry, io.EOF after the last one
+func (a *ArchiveReader) Next() (key, value []byte, err error) {
+	key, err = a.read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	value, err = a.read()
+	if err == io.EOF {
+		return nil, nil, ErrInvalidArchive
+	}
+
+	return key, value, err
+}
+
+// Length prefixed record. The buffer grows with the data actually read, so a
+// broken length can not allocate more than the archive holds
+func (a *ArchiveReader) read() ([]byte, error) {
+	n, err := binary.ReadUvarint(a.buf)
+	if err == io.EOF {
+		return nil, err
+	} else if err != nil || n > math.MaxInt64 {
+		return nil, ErrInvalidArchive
+	}
+
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, a.buf, int64(n)); err != nil {
+		return nil, ErrInvalidArchive
+	}
+
+	return b.Bytes(), nil
+}
+
+// Path of a backup file
+func ArchivePath(path, filename string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(path, "/"), filename)
+}
+
+// Write an archive to path/filename, see CreateFile
+func CreateArchive(path, filename string, fn func(a *ArchiveWriter) error) error {
+	return CreateFile(path, filename, func(w io.Writer) error {
+		return writeArchive(w, fn)
+	})
+}
+
+// Write a backup file to path/filename. Written to a temporary file first and
+// renamed when complete, so a failed backup never leaves a broken file
+func CreateFile(path, filename string, fn func(w io.Writer) error) error {
+	if err := CreateDir(path); err != nil {
+		return err
+	}
+
+	file := ArchivePath(path, filename)
+
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	err = fn(f)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(file + ".tmp")
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+func writeArchive(w io.Writer, fn func(a *ArchiveWriter) error) error {
+	a, err := NewArchiveWriter(w)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(a); err != nil {
+		return err
+	}
+
+	return a.Close()
+}
+
+// Read every entry of the archive at path/filename
+func ReadArchive(path, filename string, fn func(key, value []byte) error) error {
+	f, err := os.Open(ArchivePath(path, filename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	a, err := NewArchiveReader(f)
+	if err != nil {
+		return err
+	}
+
+	for {
+		key, value, err := a.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+}
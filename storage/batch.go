@@ -0,0 +1,47 @@
+package storage
+
+// Batch operation types
+const (
+	BatchSet = iota
+	BatchDelete
+)
+
+// One operation of a write batch
+type BatchItem struct {
+	Op         int
+	BucketName []byte
+	Key        []byte
+	Value      []byte
+}
+
+// Batch collects set and delete operations across buckets
+// and commits them as one unit via Store.Write
+type Batch struct {
+	items []BatchItem
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) Set(bucketName []byte, k []byte, v []byte) *Batch {
+	b.items = append(b.items, BatchItem{Op: BatchSet, BucketName: bucketName, Key: k, Value: v})
+	return b
+}
+
+func (b *Batch) Delete(bucketName []byte, k []byte) *Batch {
+	b.items = append(b.items, BatchItem{Op: BatchDelete, BucketName: bucketName, Key: k})
+	return b
+}
+
+func (b *Batch) Items() []BatchItem {
+	return b.items
+}
+
+func (b *Batch) Len() int {
+	return len(b.items)
+}
+
+func (b *Batch) Reset() {
+	b.items = b.items[:0]
+}
@@ -0,0 +1,20 @@
+package storage
+
+import "fmt"
+
+// Returned by conditional writes (CompareAndSwap, SetIfAbsent,
+// DeleteIfEquals) when the stored value does not match. errors.Is(err,
+// ErrConflict) is true for it
+type ConflictError struct {
+	BucketName []byte
+	Key        []byte
+	Current    []byte // nil when the key is missing
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: bucket %q key %q", ErrConflict, e.BucketName, e.Key)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
@@ -0,0 +1,15 @@
+package storage
+
+// New counter value of a stored value plus delta. Counters are saved with
+// U64tob (negative values as two's complement), nil value counts from 0
+func Incr(v []byte, delta int64) (int64, error) {
+	if v == nil {
+		return delta, nil
+	}
+
+	if len(v) != 8 {
+		return 0, ErrInvalidCounter
+	}
+
+	return int64(Btou64(v)) + delta, nil
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Items per MSet call while loading
+const loadBatchSize = 1000
+
+// Store methods used by Dump and Load. Every backend store implements it
+// (interfaces.Storage), so a dump of one engine loads into another
+type DumpStore interface {
+	ListBucket() ([]string, error)
+	ForEach(bucketName []byte, fn func(k, v []byte) error) error
+	CreateBucket(bucketName []byte) error
+	MSet(bucketName []byte, items ...KV) error
+}
+
+// One line of a dump: bucket name ("" for keys set without bucket) and
+// base64 encoded key and value
+type DumpRecord struct {
+	Bucket string `json:"bucket"`
+	KV
+}
+
+// Write every key of every bucket, and the keys set without bucket, to w as
+// JSON Lines (one DumpRecord per line). Expired keys, expire times and
+// sequences are not dumped
+func Dump(w io.Writer, s DumpStore) error {
+	buckets, err := s.ListBucket()
+	if err != nil {
+		return err
+	}
+
+	// Nil bucket first
+	buckets = append([]string{""}, buckets...)
+
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+
+	for _, bucketName := range buckets {
+		err := s.ForEach([]byte(bucketName), func(k, v []byte) error {
+			return enc.Encode(DumpRecord{
+				Bucket: bucketName,
+				KV: KV{
+					Key:   base64.StdEncoding.EncodeToString(k),
+					Value: base64.StdEncoding.EncodeToString(v),
+				},
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return buf.Flush()
+}
+
+// Read a Dump from r and write its keys to s. Missing buckets are created,
+// keys of bucket "" are set without bucket, existing keys are overwritten
+func Load(r io.Reader, s DumpStore) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+
+	created := map[string]bool{}
+	bucketName := ""
+	items := []KV{}
+
+	flush := func() error {
+		if len(items) == 0 {
+			return nil
+		}
+
+		err := s.MSet([]byte(bucketName), items...)
+		items = items[:0]
+
+		return err
+	}
+
+	for line := 1; ; line++ {
+		var rec DumpRecord
+
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("dump line %d: %w", line, err)
+		}
+
+		k, err := base64.StdEncoding.DecodeString(rec.Key)
+		if err != nil {
+			return fmt.Errorf("dump line %d key: %w", line, err)
+		}
+
+		v, err := base64.StdEncoding.DecodeString(rec.Value)
+		if err != nil {
+			return fmt.Errorf("dump line %d value: %w", line, err)
+		}
+
+		if rec.Bucket != bucketName || len(items) == loadBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		if rec.Bucket != "" && !created[rec.Bucket] {
+			if err := s.CreateBucket([]byte(rec.Bucket)); err != nil {
+				return err
+			}
+
+			created[rec.Bucket] = true
+		}
+
+		bucketName = rec.Bucket
+		items = append(items, KV{Key: string(k), Value: string(v)})
+	}
+
+	return flush()
+}
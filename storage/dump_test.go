@@ -0,0 +1,77 @@
+package storage_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
+	leveldbstorage "github.com/uretgec/mylsmdb/storage/leveldb"
+	nutsdbstorage "github.com/uretgec/mylsmdb/storage/nutsdb"
+	pogrebstorage "github.com/uretgec/mylsmdb/storage/pogreb"
+)
+
+func TestDumpAcrossEngines(t *testing.T) {
+	defer os.RemoveAll("./db")
+
+	src, err := leveldbstorage.NewStore([]string{"posts"}, "./db/", "dump_leveldb", false)
+	assert.NoError(t, err)
+
+	err = src.CreateBucket([]byte("comments"))
+	assert.NoError(t, err)
+
+	_, err = src.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	_, err = src.Set([]byte("posts"), storage.U64tob(2), []byte{0, 1, 255})
+	assert.NoError(t, err)
+
+	_, err = src.Set([]byte("comments"), []byte("test_1"), []byte("comment one"))
+	assert.NoError(t, err)
+
+	// Key without bucket
+	_, err = src.Set(nil, []byte("test_1"), []byte("no bucket"))
+	assert.NoError(t, err)
+
+	var dump bytes.Buffer
+	err = storage.Dump(&dump, src)
+	assert.NoError(t, err)
+
+	err = src.CloseStore()
+	assert.NoError(t, err)
+
+	pogreb, err := pogrebstorage.NewStore([]string{"options"}, "./db/", "dump_pogreb", false)
+	assert.NoError(t, err)
+
+	nutsdb, err := nutsdbstorage.NewStore([]string{"options"}, "./db/", "dump_nutsdb", false)
+	assert.NoError(t, err)
+
+	for _, dst := range []interfaces.Storage{pogreb, nutsdb} {
+		err = storage.Load(bytes.NewReader(dump.Bytes()), dst)
+		assert.NoError(t, err)
+
+		assert.Equal(t, dst.HasBucket([]byte("posts")), true)
+		assert.Equal(t, dst.HasBucket([]byte("comments")), true)
+
+		res, err := dst.Get([]byte("posts"), []byte("test_1"))
+		assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+		assert.NoError(t, err)
+
+		res, err = dst.Get([]byte("posts"), storage.U64tob(2))
+		assert.Equal(t, true, bytes.Equal(res, []byte{0, 1, 255}))
+		assert.NoError(t, err)
+
+		res, err = dst.Get([]byte("comments"), []byte("test_1"))
+		assert.Equal(t, true, bytes.Equal(res, []byte("comment one")))
+		assert.NoError(t, err)
+
+		res, err = dst.Get(nil, []byte("test_1"))
+		assert.Equal(t, true, bytes.Equal(res, []byte("no bucket")))
+		assert.NoError(t, err)
+
+		err = dst.CloseStore()
+		assert.NoError(t, err)
+	}
+}
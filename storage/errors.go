@@ -0,0 +1,24 @@
+package storage
+
+import "errors"
+
+// Shared errors returned by all backend stores. Use errors.Is to check them
+var (
+	ErrUnknownBucket   = errors.New("unknown bucket name")
+	ErrInvalidBucket   = errors.New("invalid bucket name")
+	ErrReadOnly        = errors.New("readonly mod active")
+	ErrEmptyKey        = errors.New("key is empty")
+	ErrEmptyValue      = errors.New("value is empty")
+	ErrNotImplemented  = errors.New("not implemented")
+	ErrClosed          = errors.New("store closed")
+	ErrNotFound        = errors.New("key not found")
+	ErrInvalidCursor   = errors.New("invalid cursor")
+	ErrInvalidEnvelope = errors.New("invalid value envelope")
+	ErrInvalidCounter  = errors.New("value is not a counter")
+	ErrConflict        = errors.New("conflict")
+	ErrReleased        = errors.New("snapshot released")
+	ErrInvalidArchive  = errors.New("invalid backup archive")
+
+	// Return it from a ForEach callback to stop iteration without error
+	ErrStopIteration = errors.New("stop iteration")
+)
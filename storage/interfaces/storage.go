@@ -1,23 +1,77 @@
 package interfaces
 
+import (
+	"time"
+
+	"github.com/uretgec/mylsmdb/storage"
+)
+
+// Storage is implemented by every backend store (leveldb, pogreb and nutsdb)
 type Storage interface {
-	CloseStore()
+	CloseStore() error
 	SyncStore()
 
 	Set(bucketName []byte, k []byte, data []byte) ([]byte, error)
-	MSet(bucketName []byte, k []byte, data []byte) ([]byte, error)
+	SetWithTTL(bucketName []byte, k []byte, data []byte, ttl time.Duration) ([]byte, error)
+	TTL(bucketName []byte, k []byte) (time.Duration, error)
+	Incr(bucketName []byte, k []byte, delta int64) (int64, error)
+	Decr(bucketName []byte, k []byte, delta int64) (int64, error)
+	CompareAndSwap(bucketName []byte, k []byte, oldValue []byte, newValue []byte) error
+	SetIfAbsent(bucketName []byte, k []byte, v []byte) error
+	DeleteIfEquals(bucketName []byte, k []byte, v []byte) error
+	NextSequence(bucketName []byte) (uint64, error)
+	Append(bucketName []byte, v []byte) (uint64, error)
+	Insert(bucketName []byte, v []byte) (int64, error)
+	MSet(bucketName []byte, items ...storage.KV) error
 	Get(bucketName []byte, k []byte) ([]byte, error)
-	MGet(bucketName []byte, keys ...[]byte) (interface{}, error)
+	MGet(bucketName []byte, keys ...[]byte) (map[string]interface{}, error)
 	List(bucketName []byte, cursor []byte, perpage int) ([]string, error)
 	PrevList(bucketName []byte, cursor []byte, perpage int) ([]string, error)
+	ListKV(bucketName []byte, cursor []byte, perpage int) ([]storage.KV, error)
+	PrevListKV(bucketName []byte, cursor []byte, perpage int) ([]storage.KV, error)
+	ListPage(bucketName []byte, cursor string, perpage int) (*storage.Page, error)
+	PrevListPage(bucketName []byte, cursor string, perpage int) (*storage.Page, error)
+	Range(bucketName []byte, start []byte, end []byte, opts storage.RangeOptions) ([]storage.KV, error)
+	PrefixScan(bucketName []byte, prefix []byte, limit int) ([]storage.KV, error)
+	ForEach(bucketName []byte, fn func(k, v []byte) error) error
 	Delete(bucketName []byte, k []byte) error
+	Write(batch *storage.Batch) error
 
 	KeyExist(bucketName []byte, k []byte) (bool, error)
 
+	Snapshot() (Snapshot, error)
+	Update(fn func(tx Tx) error) error
+	View(fn func(tx Tx) error) error
+
 	HasBucket(bucketName []byte) bool
 	ListBucket() ([]string, error)
 	DeleteBucket(bucketName []byte) error
+	CreateBucket(bucketName []byte) error
+	DropBucket(bucketName []byte) error
 
 	Backup(path, filename string) error
 	Restore(path, filename string) error
 }
+
+// Dump and Load work with every store
+var _ storage.DumpStore = (Storage)(nil)
+
+// Snapshot is a read-only view of a store, Release it when done
+type Snapshot interface {
+	Get(bucketName []byte, k []byte) ([]byte, error)
+	MGet(bucketName []byte, keys ...[]byte) (map[string]interface{}, error)
+	List(bucketName []byte, cursor []byte, perpage int) ([]string, error)
+	ForEach(bucketName []byte, fn func(k, v []byte) error) error
+	Release()
+}
+
+// Tx is the store view inside Update and View closures. Writes return
+// storage.ErrReadOnly in View. Reads inside Update see the writes made
+// before them in the same closure on leveldb and pogreb, not on nutsdb
+// (it applies writes on commit)
+type Tx interface {
+	Get(bucketName []byte, k []byte) ([]byte, error)
+	Set(bucketName []byte, k []byte, v []byte) error
+	Delete(bucketName []byte, k []byte) error
+	List(bucketName []byte, cursor []byte, perpage int) ([]string, error)
+}
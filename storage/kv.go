@@ -20,3 +20,17 @@ func (bbi *KV) UnmarshalBinary(data []byte) error {
 
 	return nil
 }
+
+// Values of items, same order. Returns nil for empty list
+func Values(items []KV) []string {
+	if len(items) == 0 {
+		return nil
+	}
+
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		list = append(list, item.Value)
+	}
+
+	return list
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Reserved bucket for store metadata (key layout, bucket catalog etc.)
+// in prefix based stores. Not visible as a user bucket
+var MetaBucket = []byte("_mylsmdb")
+
+// Layout versions, saved under LayoutKey. Version 1 (no layout key) is the
+// "<bucket>-<key>" layout, 2 the length prefixed keys, 3 adds value envelopes
+const (
+	LayoutVersionKeys     = "2"
+	LayoutVersionEnvelope = "3"
+	LayoutVersion         = LayoutVersionEnvelope
+)
+
+// Returned when a store with the old key layout opened readonly
+var ErrLegacyLayout = errors.New("legacy key layout, open the store writable once to migrate")
+
+// Db key of the layout version
+func LayoutKey() []byte {
+	return []byte(GenerateKey(MetaBucket, []byte("layout")))
+}
+
+// Staging key of a value while migrating to envelopes, nil gives the prefix
+func EnvelopeKey(dbkey []byte) []byte {
+	return []byte(GenerateKey(MetaBucket, append([]byte("envelope:"), dbkey...)))
+}
+
+// Metadata keys are not user data
+func IsMetaKey(dbkey []byte) bool {
+	bucketName, _, ok := ParseKey(dbkey)
+
+	return ok && bytes.Equal(bucketName, MetaBucket)
+}
+
+// Db key of a bucket catalog entry, nil bucket name gives the catalog prefix
+func BucketKey(bucketName []byte) []byte {
+	return []byte(GenerateKey(MetaBucket, append([]byte("bucket:"), bucketName...)))
+}
+
+// Db key of the NextSequence counter of a bucket
+func SequenceKey(bucketName []byte) []byte {
+	return []byte(GenerateKey(MetaBucket, append([]byte("sequence:"), bucketName...)))
+}
+
+// User bucket names can not be empty or start with the reserved metadata bucket name
+func ValidBucketName(bucketName []byte) error {
+	if len(bucketName) == 0 || bytes.HasPrefix(bucketName, MetaBucket) {
+		return ErrInvalidBucket
+	}
+
+	return nil
+}
+
+// Bucket name and real key of a key in the legacy "<bucket>-<key>" layout.
+// Longest known bucket wins, keys without known bucket belong to no bucket
+func LegacyKey(dbkey []byte, bucketList []string) (bucketName []byte, k []byte) {
+	for _, b := range bucketList {
+		if len(b) <= len(bucketName) {
+			continue
+		}
+
+		if bytes.HasPrefix(dbkey, []byte(b+"-")) {
+			bucketName = []byte(b)
+		}
+	}
+
+	if len(bucketName) == 0 {
+		return nil, dbkey
+	}
+
+	return bucketName, dbkey[len(bucketName)+1:]
+}
+
+// Legacy key check while migrating. Keys already in the current layout
+// (known bucket or metadata) are skipped, so an interrupted migration can run again
+func IsLegacyKey(dbkey []byte, bucketList []string) bool {
+	bucketName, _, ok := ParseKey(dbkey)
+	if !ok {
+		return true
+	}
+
+	if bytes.Equal(bucketName, MetaBucket) {
+		return false
+	}
+
+	if len(bucketName) == 0 {
+		return false
+	}
+
+	return !Contains(bucketList, bucketName)
+}
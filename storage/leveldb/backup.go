@@ -0,0 +1,133 @@
+package leveldbstorage
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/uretgec/mylsmdb/storage"
+)
+
+// Entries per leveldb batch while restoring
+const restoreBatchSize = 1000
+
+// Write all db entries (buckets, metadata and ttl envelopes) as a
+// storage archive to path/filename. Entries are read from a leveldb
+// snapshot, so writes can continue while backing up
+func (s *Store) Backup(path, filename string) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(nil); err != nil {
+		return err
+	}
+
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return storage.CreateArchive(path, filename, func(a *storage.ArchiveWriter) error {
+		c := snap.NewIterator(nil, nil)
+		defer c.Release()
+
+		for c.Next() {
+			err := a.Write(c.Key(), c.Value())
+			if err != nil {
+				return err
+			}
+		}
+
+		return c.Error()
+	})
+}
+
+// Replace the db with a Backup archive. The archive is loaded into a new
+// leveldb folder next to the db while the store keeps serving calls. Then
+// running calls are waited for, the new folder replaces the db folder and is
+// reopened; calls made meanwhile wait for it. Buckets created after NewStore
+// come from the archive catalog. The store is closed when no db can be
+// opened again
+func (s *Store) Restore(path, filename string) error {
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	// Per call folder
+	dir, err := os.MkdirTemp(filepath.Dir(s.dir), filepath.Base(s.dir)+".restore")
+	if err != nil {
+		return err
+	}
+
+	err = restoreArchive(dir, path, filename)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	s.sweeper.Stop()
+	s.sweeper = nil
+
+	err = s.db.Close()
+	if err == nil {
+		err = storage.SwapDir(s.dir, dir)
+	}
+
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+
+	// Reopen the restored db, or the old one when the swap failed
+	if oerr := s.open(); oerr != nil {
+		atomic.StoreInt32(&s.closed, 1)
+
+		if err == nil {
+			err = oerr
+		}
+	}
+
+	return err
+}
+
+// Load archive entries into a new, empty leveldb folder
+func restoreArchive(dir, path, filename string) error {
+	db, err := leveldb.OpenFile(dir, &opt.Options{ErrorIfExist: true})
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+
+	err = storage.ReadArchive(path, filename, func(key, value []byte) error {
+		batch.Put(key, value)
+		if batch.Len() < restoreBatchSize {
+			return nil
+		}
+
+		err := db.Write(batch, nil)
+		batch.Reset()
+
+		return err
+	})
+
+	if err == nil {
+		err = db.Write(batch, nil)
+	}
+
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
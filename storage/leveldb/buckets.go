@@ -0,0 +1,116 @@
+package leveldbstorage
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/uretgec/mylsmdb/storage"
+)
+
+// Merge the bucket catalog saved in the metadata bucket with the bucket list
+// given to NewStore, and save the new ones
+func (s *Store) loadBuckets() error {
+	for _, b := range s.bucketList {
+		if err := storage.ValidBucketName([]byte(b)); err != nil {
+			return err
+		}
+	}
+
+	prefix := storage.BucketKey(nil)
+
+	c := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+	for c.Next() {
+		bucketName := c.Key()[len(prefix):]
+		if !storage.Contains(s.bucketList, bucketName) {
+			s.bucketList = append(s.bucketList, string(bucketName))
+		}
+	}
+	c.Release()
+
+	if err := c.Error(); err != nil {
+		return err
+	}
+
+	if s.readOnly {
+		return nil
+	}
+
+	batch := new(leveldb.Batch)
+	for _, b := range s.bucketList {
+		batch.Put(storage.BucketKey([]byte(b)), []byte("1"))
+	}
+
+	return s.db.Write(batch, nil)
+}
+
+// Add a bucket at runtime, saved in the bucket catalog.
+// Creating an existing bucket is not an error
+func (s *Store) CreateBucket(bucketName []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	if err := storage.ValidBucketName(bucketName); err != nil {
+		return err
+	}
+
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+
+	if storage.Contains(s.bucketList, bucketName) {
+		return nil
+	}
+
+	err := s.db.Put(storage.BucketKey(bucketName), []byte("1"), nil)
+	if err != nil {
+		return err
+	}
+
+	s.bucketList = append(s.bucketList, string(bucketName))
+	return nil
+}
+
+// Delete a bucket with all keys and its sequence, and remove it from the bucket
+// catalog in one batch. Holds the write lock, so no write reaches the bucket
+// while its keys are deleted
+func (s *Store) DropBucket(bucketName []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	if err := storage.ValidBucketName(bucketName); err != nil {
+		return err
+	}
+
+	// Same lock order as Update: s.mu, then bucketMu
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bucketMu.Lock()
+	if !storage.Contains(s.bucketList, bucketName) {
+		s.bucketMu.Unlock()
+		return storage.ErrUnknownBucket
+	}
+
+	s.bucketList = storage.Remove(s.bucketList, bucketName)
+	s.bucketMu.Unlock()
+
+	batch := new(leveldb.Batch)
+	batch.Delete(storage.BucketKey(bucketName))
+	batch.Delete(storage.SequenceKey(bucketName))
+
+	err := s.deleteBucket(bucketName, batch)
+	if err != nil {
+		// Nothing deleted, bucket still in the catalog
+		s.bucketMu.Lock()
+		s.bucketList = append(s.bucketList, string(bucketName))
+		s.bucketMu.Unlock()
+	}
+
+	return err
+}
@@ -0,0 +1,117 @@
+package leveldbstorage
+
+import (
+	"sync/atomic"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
+)
+
+// Read-only view of the db at the time of Store.Snapshot, backed by a
+// leveldb snapshot. Writes after it are not visible. Restore replaces the
+// db, later calls return storage.ErrReleased
+type Snapshot struct {
+	s        *Store
+	db       *leveldb.DB
+	snap     *leveldb.Snapshot
+	released int32
+}
+
+var _ interfaces.Snapshot = (*Snapshot)(nil)
+
+func (s *Store) Snapshot() (interfaces.Snapshot, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(nil); err != nil {
+		return nil, err
+	}
+
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{s: s, db: s.db, snap: snap}, nil
+}
+
+func (sn *Snapshot) Get(bucketName []byte, k []byte) ([]byte, error) {
+	sn.s.dbMu.RLock()
+	defer sn.s.dbMu.RUnlock()
+
+	if err := sn.check(bucketName); err != nil {
+		return nil, err
+	}
+
+	return get(sn.snap, []byte(storage.GenerateKey(bucketName, k)))
+}
+
+func (sn *Snapshot) MGet(bucketName []byte, keys ...[]byte) (map[string]interface{}, error) {
+	sn.s.dbMu.RLock()
+	defer sn.s.dbMu.RUnlock()
+
+	if err := sn.check(bucketName); err != nil {
+		return nil, err
+	}
+
+	return mget(sn.snap, bucketName, keys), nil
+}
+
+// order by asc
+func (sn *Snapshot) List(bucketName []byte, k []byte, perpage int) ([]string, error) {
+	items, err := sn.listKV(bucketName, k, perpage)
+
+	return storage.Values(items), err
+}
+
+// Same as Store.ForEach
+func (sn *Snapshot) ForEach(bucketName []byte, fn func(k, v []byte) error) error {
+	sn.s.dbMu.RLock()
+	err := sn.check(bucketName)
+	sn.s.dbMu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	return sn.s.forEach(sn.db, sn.snap, bucketName, fn)
+}
+
+func (sn *Snapshot) listKV(bucketName []byte, k []byte, perpage int) ([]storage.KV, error) {
+	sn.s.dbMu.RLock()
+	defer sn.s.dbMu.RUnlock()
+
+	if err := sn.check(bucketName); err != nil {
+		return nil, err
+	}
+
+	return listKV(sn.snap, bucketName, k, perpage)
+}
+
+// Release the leveldb snapshot, safe to call more than once
+func (sn *Snapshot) Release() {
+	sn.s.dbMu.RLock()
+	defer sn.s.dbMu.RUnlock()
+
+	if atomic.CompareAndSwapInt32(&sn.released, 0, 1) {
+		sn.snap.Release()
+	}
+}
+
+// Released snapshot, closed store, restored db and unknown bucket check
+func (sn *Snapshot) check(bucketName []byte) error {
+	if atomic.LoadInt32(&sn.released) == 1 {
+		return storage.ErrReleased
+	}
+
+	if err := sn.s.checkBucket(nil); err != nil {
+		return err
+	}
+
+	if sn.db != sn.s.db {
+		return storage.ErrReleased
+	}
+
+	return sn.s.checkBucket(bucketName)
+}
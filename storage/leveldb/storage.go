@@ -2,49 +2,195 @@ package leveldbstorage
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/bwmarrin/snowflake"
 	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
 
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 type Store struct {
 	db         *leveldb.DB
+	dir        string
+	options    storage.Options
+	bucketMu   sync.RWMutex
 	bucketList []string
+	buckets    []string // bucket list given to NewStore
 	readOnly   bool
+	closed     int32
+	sweeper    *storage.Sweeper
+	node       *snowflake.Node
+
+	// Every call holds it shared while it uses db. Restore and CloseStore
+	// hold it alone to swap or close it. Taken before mu
+	dbMu sync.RWMutex
+
+	// Writes share it from their bucket check on. Update holds it alone: its
+	// leveldb transaction may write any key, so no stripe lock covers it.
+	// DropBucket too, so no write lands in a dropped bucket
+	mu sync.RWMutex
+
+	// Writes hold the locks of their keys, so no write lands between the
+	// read and write of Incr and conditional writes of the same key
+	locks storage.KeyLocks
 }
 
-func NewStore(bucketList []string, path string, dbFolder string, readOnly bool) (*Store, error) {
+var _ interfaces.Storage = (*Store)(nil)
+
+func NewStore(bucketList []string, path string, dbFolder string, readOnly bool, opts ...storage.Option) (*Store, error) {
 	s := &Store{}
-	s.bucketList = bucketList
+	s.buckets = append([]string{}, bucketList...)
 	s.readOnly = readOnly
+	s.options = storage.NewOptions(opts...)
+	s.dir = fmt.Sprintf("%s/%s", strings.TrimSuffix(path, "/"), dbFolder)
+
+	// Insert id generator
+	node, err := snowflake.NewNode(s.options.NodeID)
+	if err != nil {
+		return s, err
+	}
+
+	s.node = node
 
 	// Create dir if not exist
 	_ = storage.CreateDir(path)
 
-	// Open DB
+	err = s.open()
+	if err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// Open DB folder, migrate it, load the bucket catalog and start the sweeper
+func (s *Store) open() error {
 	db, err := leveldb.OpenFile(
-		fmt.Sprintf("%s/%s", strings.TrimSuffix(path, "/"), dbFolder),
+		s.dir,
 		&opt.Options{
-			ReadOnly:               readOnly,
+			ReadOnly:               s.readOnly,
 			OpenFilesCacheCapacity: 256,
 		},
 	)
 
 	if err != nil {
-		return s, err
+		return err
 	}
 
 	s.db = db
-	return s, nil
+
+	s.bucketMu.Lock()
+	s.bucketList = append([]string{}, s.buckets...)
+
+	err = s.migrate()
+	if err == nil {
+		err = s.loadBuckets()
+	}
+	s.bucketMu.Unlock()
+
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	if !s.readOnly {
+		s.sweeper = storage.NewSweeper(s.options.SweepInterval, func() {
+			_ = s.sweep()
+		})
+	}
+
+	return nil
 }
 
+// Bring the db to the current layout in one transaction. Keys of the legacy
+// "<bucket>-<key>" layout rewritten, values of older layouts wrapped in an
+// envelope. New databases only get the layout version
+func (s *Store) migrate() error {
+	layout := storage.LayoutKey()
+
+	version, err := s.db.Get(layout, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+
+	if string(version) == storage.LayoutVersion {
+		return nil
+	}
+
+	c := s.db.NewIterator(nil, nil)
+	defer c.Release()
+
+	if s.readOnly {
+		if version != nil || c.First() {
+			return storage.ErrLegacyLayout
+		}
+
+		return c.Error()
+	}
+
+	tr, err := s.db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+
+	// Iterator reads the db, transaction writes are not visible until commit
+	for c.Next() {
+		key := c.Key()
+		if storage.IsMetaKey(key) {
+			continue
+		}
+
+		if version == nil && storage.IsLegacyKey(key, s.bucketList) {
+			bucketName, k := storage.LegacyKey(key, s.bucketList)
+
+			err = tr.Delete(key, nil)
+			key = []byte(storage.GenerateKey(bucketName, k))
+		}
+
+		if err == nil {
+			err = tr.Put(key, storage.Wrap(c.Value(), 0), nil)
+		}
+
+		if err != nil {
+			tr.Discard()
+			return err
+		}
+	}
+
+	err = c.Error()
+	if err == nil {
+		err = tr.Put(layout, []byte(storage.LayoutVersion), nil)
+	}
+
+	if err != nil {
+		tr.Discard()
+		return err
+	}
+
+	return tr.Commit()
+}
+
+// Waits for running calls
 func (s *Store) CloseStore() error {
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return storage.ErrClosed
+	}
+
+	s.sweeper.Stop()
+	s.sweeper = nil
+
 	return s.db.Close()
 }
 
@@ -53,81 +199,242 @@ func (s *Store) SyncStore() {
 }
 
 func (s *Store) Set(bucketName []byte, k []byte, v []byte) ([]byte, error) {
-	if s.readOnly {
-		return nil, errors.New("readonly mod active")
+	return s.SetWithTTL(bucketName, k, v, 0)
+}
+
+// Key expires after ttl, ttl <= 0 means no expiry
+func (s *Store) SetWithTTL(bucketName []byte, k []byte, v []byte, ttl time.Duration) ([]byte, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return nil, err
 	}
 
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	if len(k) == 0 {
+		return nil, storage.ErrEmptyKey
 	}
 
-	if len(k) == 0 || len(v) == 0 {
-		return nil, errors.New("key or value not found")
+	if len(v) == 0 {
+		return nil, storage.ErrEmptyValue
 	}
 
-	gkey := storage.GenerateKey(bucketName, k)
+	gkey := []byte(storage.GenerateKey(bucketName, k))
 
-	err := s.db.Put([]byte(gkey), v, nil)
+	m := s.locks.For(gkey)
+	m.Lock()
+	defer m.Unlock()
+
+	err := s.db.Put(gkey, storage.Wrap(v, storage.ExpireAt(ttl)), nil)
 
 	return k, err
 }
 
-// TODO
-func (s *Store) MSet(bucketName []byte, k []byte, v []byte) ([]byte, error) {
-	return []byte(""), errors.New("not implemented")
+// All items written atomically with one leveldb batch
+func (s *Store) MSet(bucketName []byte, items ...storage.KV) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if len(item.Key) == 0 {
+			return storage.ErrEmptyKey
+		}
+
+		if len(item.Value) == 0 {
+			return storage.ErrEmptyValue
+		}
+	}
+
+	keys := [][]byte{}
+
+	batch := new(leveldb.Batch)
+	for _, item := range items {
+		gkey := []byte(storage.GenerateKey(bucketName, []byte(item.Key)))
+		batch.Put(gkey, storage.Wrap([]byte(item.Value), 0))
+		keys = append(keys, gkey)
+	}
+
+	unlock := s.locks.Lock(keys...)
+	defer unlock()
+
+	return s.db.Write(batch, nil)
 }
 
 func (s *Store) Get(bucketName []byte, k []byte) ([]byte, error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
 	}
 
-	gkey := storage.GenerateKey(bucketName, k)
+	return get(s.db, []byte(storage.GenerateKey(bucketName, k)))
+}
+
+// Read methods shared by leveldb.DB, leveldb.Snapshot and leveldb.Transaction
+type reader interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+// User value of a db key, storage.ErrNotFound for missing and expired keys
+func get(r reader, gkey []byte) ([]byte, error) {
+	v, _, err := getEnvelope(r, gkey)
+
+	return v, err
+}
 
-	v, err := s.db.Get([]byte(gkey), nil)
+// User value and expire time of a db key, storage.ErrNotFound for missing and expired keys
+func getEnvelope(r reader, gkey []byte) ([]byte, int64, error) {
+	data, err := r.Get(gkey, nil)
 	if err == leveldb.ErrNotFound {
-		return v, nil
+		return nil, 0, storage.ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
 	}
 
-	return v, err
+	v, expireAt, err := storage.Unwrap(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if storage.Expired(expireAt) {
+		return nil, 0, storage.ErrNotFound
+	}
+
+	return v, expireAt, nil
+}
+
+// Remaining time to live of a key, storage.NoTTL for keys without expiry
+func (s *Store) TTL(bucketName []byte, k []byte) (time.Duration, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return 0, err
+	}
+
+	_, expireAt, err := getEnvelope(s.db, []byte(storage.GenerateKey(bucketName, k)))
+	if err != nil {
+		return 0, err
+	}
+
+	return storage.Remaining(expireAt), nil
+}
+
+// Add delta to the counter of a key and return the new value. Missing key
+// counts from 0, key ttl kept. Holds the key lock, so it is atomic against
+// other writes of the key
+func (s *Store) Incr(bucketName []byte, k []byte, delta int64) (int64, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return 0, err
+	}
+
+	if len(k) == 0 {
+		return 0, storage.ErrEmptyKey
+	}
+
+	gkey := []byte(storage.GenerateKey(bucketName, k))
+
+	m := s.locks.For(gkey)
+	m.Lock()
+	defer m.Unlock()
+
+	v, expireAt, err := getEnvelope(s.db, gkey)
+	if err != nil && err != storage.ErrNotFound {
+		return 0, err
+	}
+
+	n, err := storage.Incr(v, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, s.db.Put(gkey, storage.Wrap(storage.U64tob(int(n)), expireAt), nil)
+}
+
+// Same as Incr with -delta
+func (s *Store) Decr(bucketName []byte, k []byte, delta int64) (int64, error) {
+	return s.Incr(bucketName, k, -delta)
 }
 
 func (s *Store) MGet(bucketName []byte, keys ...[]byte) (list map[string]interface{}, err error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
 	}
 
+	return mget(s.db, bucketName, keys), nil
+}
+
+// Values of found keys
+func mget(r reader, bucketName []byte, keys [][]byte) map[string]interface{} {
 	items := make(map[string]interface{})
 
 	for _, k := range keys {
-		gkey := storage.GenerateKey(bucketName, k)
-
-		v, err := s.db.Get([]byte(gkey), nil)
-		if err == leveldb.ErrNotFound {
-			continue
-		} else if err != nil {
+		v, err := get(r, []byte(storage.GenerateKey(bucketName, k)))
+		if err != nil {
 			continue
 		}
 
 		items[string(k)] = string(v)
 	}
 
-	return items, nil
+	return items
 }
 
 // order by asc
 func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, err error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	items, err := s.ListKV(bucketName, k, perpage)
+
+	return storage.Values(items), err
+}
+
+// order by desc
+func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []string, err error) {
+	items, err := s.PrevListKV(bucketName, k, perpage)
+
+	return storage.Values(items), err
+}
+
+// order by asc, keys with values
+func (s *Store) ListKV(bucketName []byte, k []byte, perpage int) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
 	}
 
+	return listKV(s.db, bucketName, k, perpage)
+}
+
+func listKV(r reader, bucketName []byte, k []byte, perpage int) (list []storage.KV, err error) {
 	counter := 1
 
-	items := []string{}
+	items := []storage.KV{}
 
 	prefix := storage.GenerateKey(bucketName, []byte(""))
 
-	c := s.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	c := r.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
 
 	if len(k) > 0 {
 		gkey := storage.GenerateKey(bucketName, k)
@@ -137,7 +444,12 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 				continue
 			}
 
-			items = append(items, string(c.Value()))
+			v, alive := live(c.Value())
+			if !alive {
+				continue
+			}
+
+			items = append(items, storage.KV{Key: storage.GetRealKey(c.Key(), bucketName), Value: string(v)})
 
 			if counter >= perpage {
 				break
@@ -148,7 +460,12 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 	} else {
 		for c.Next() {
 
-			items = append(items, string(c.Value()))
+			v, alive := live(c.Value())
+			if !alive {
+				continue
+			}
+
+			items = append(items, storage.KV{Key: storage.GetRealKey(c.Key(), bucketName), Value: string(v)})
 
 			if counter >= perpage {
 				break
@@ -168,15 +485,19 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 	return items, err
 }
 
-// order by desc
-func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []string, err error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
+// order by desc, keys with values. Starts at the key before the cursor, the
+// cursor key itself is not returned
+func (s *Store) PrevListKV(bucketName []byte, k []byte, perpage int) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
 	}
 
 	counter := 1
 
-	items := []string{}
+	items := []storage.KV{}
 
 	prefix := storage.GenerateKey(bucketName, nil)
 
@@ -184,13 +505,23 @@ func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []strin
 
 	if len(k) > 0 {
 		gkey := storage.GenerateKey(bucketName, k)
-		for ok := c.Seek([]byte(gkey)); ok; ok = c.Prev() {
 
-			if bytes.Equal([]byte(gkey), k) {
+		// Seek finds the first key >= cursor, step back to the last key < cursor
+		ok := c.Seek([]byte(gkey))
+		if ok {
+			ok = c.Prev()
+		} else {
+			ok = c.Last()
+		}
+
+		for ; ok; ok = c.Prev() {
+
+			v, alive := live(c.Value())
+			if !alive {
 				continue
 			}
 
-			items = append(items, string(c.Value()))
+			items = append(items, storage.KV{Key: storage.GetRealKey(c.Key(), bucketName), Value: string(v)})
 
 			if counter >= perpage {
 				break
@@ -201,7 +532,12 @@ func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []strin
 	} else {
 		for ok := c.Last(); ok; ok = c.Prev() {
 
-			items = append(items, string(c.Value()))
+			v, alive := live(c.Value())
+			if !alive {
+				continue
+			}
+
+			items = append(items, storage.KV{Key: storage.GetRealKey(c.Key(), bucketName), Value: string(v)})
 
 			if counter >= perpage {
 				break
@@ -221,72 +557,446 @@ func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []strin
 	return items, err
 }
 
-func (s *Store) KeyExist(bucketName []byte, k []byte) (bool, error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return false, errors.New("unknown bucket name")
+// order by asc, one page with cursors
+func (s *Store) ListPage(bucketName []byte, cursor string, perpage int) (*storage.Page, error) {
+	return storage.ListPage(func(k []byte, n int) ([]storage.KV, error) {
+		return s.ListKV(bucketName, k, n)
+	}, cursor, perpage)
+}
+
+// order by desc, one page with cursors
+func (s *Store) PrevListPage(bucketName []byte, cursor string, perpage int) (*storage.Page, error) {
+	return storage.ListPage(func(k []byte, n int) ([]storage.KV, error) {
+		return s.PrevListKV(bucketName, k, n)
+	}, cursor, perpage)
+}
+
+// Keys between start and end (inclusive unless opts say otherwise), via util.Range
+func (s *Store) Range(bucketName []byte, start []byte, end []byte, opts storage.RangeOptions) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
 	}
 
-	gkey := storage.GenerateKey(bucketName, k)
+	prefix := storage.GenerateKey(bucketName, nil)
+	slice := util.BytesPrefix([]byte(prefix))
 
-	v, err := s.db.Get([]byte(gkey), nil)
-	if err == leveldb.ErrNotFound {
+	if len(start) > 0 {
+		slice.Start = []byte(storage.GenerateKey(bucketName, start))
+	}
+
+	if len(end) > 0 {
+		// util.Range limit is exclusive, the smallest key after end includes it
+		slice.Limit = append([]byte(storage.GenerateKey(bucketName, end)), 0)
+	}
+
+	items := []storage.KV{}
+
+	c := s.db.NewIterator(slice, nil)
+
+	next := c.Next
+	if opts.Reverse {
+		next = c.Prev
+	}
+
+	ok := c.First()
+	if opts.Reverse {
+		ok = c.Last()
+	}
+
+	for ; ok && !opts.Full(len(items)); ok = next() {
+		k := []byte(storage.GetRealKey(c.Key(), bucketName))
+		if !opts.InRange(k, start, end) {
+			continue
+		}
+
+		v, alive := live(c.Value())
+		if !alive {
+			continue
+		}
+
+		items = append(items, storage.KV{Key: string(k), Value: string(v)})
+	}
+
+	c.Release()
+	err = c.Error()
+
+	if len(items) == 0 {
+		return nil, err
+	}
+
+	return items, err
+}
+
+// Keys starting with prefix in a bucket, limit 0 means no limit
+func (s *Store) PrefixScan(bucketName []byte, prefix []byte, limit int) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	gprefix := storage.GenerateKey(bucketName, prefix)
+
+	items := []storage.KV{}
+
+	c := s.db.NewIterator(util.BytesPrefix([]byte(gprefix)), nil)
+	for c.Next() {
+		v, alive := live(c.Value())
+		if !alive {
+			continue
+		}
+
+		items = append(items, storage.KV{Key: storage.GetRealKey(c.Key(), bucketName), Value: string(v)})
+
+		if limit > 0 && len(items) >= limit {
+			break
+		}
+	}
+
+	c.Release()
+	err = c.Error()
+
+	if len(items) == 0 {
+		return nil, err
+	}
+
+	return items, err
+}
+
+// Call fn for every key of a bucket order by asc, iterating a leveldb
+// snapshot: writes made meanwhile are not seen. The store lock is only held
+// while the iterator steps, so fn may call the store. k and v are only valid
+// during the call. fn may return storage.ErrStopIteration to stop early. A
+// Restore meanwhile ends it with storage.ErrReleased
+func (s *Store) ForEach(bucketName []byte, fn func(k, v []byte) error) error {
+	s.dbMu.RLock()
+	if err := s.checkBucket(bucketName); err != nil {
+		s.dbMu.RUnlock()
+		return err
+	}
+
+	db := s.db
+	snap, err := db.GetSnapshot()
+	s.dbMu.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		s.dbMu.RLock()
+		snap.Release()
+		s.dbMu.RUnlock()
+	}()
+
+	return s.forEach(db, snap, bucketName, fn)
+}
+
+// Iterate a bucket of snap, a snapshot of db. fn runs without dbMu
+func (s *Store) forEach(db *leveldb.DB, snap *leveldb.Snapshot, bucketName []byte, fn func(k, v []byte) error) error {
+	prefix := storage.GenerateKey(bucketName, nil)
+
+	s.dbMu.RLock()
+	c := snap.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	s.dbMu.RUnlock()
+
+	defer func() {
+		s.dbMu.RLock()
+		c.Release()
+		s.dbMu.RUnlock()
+	}()
+
+	for {
+		k, v, ok, err := s.next(db, c, bucketName)
+		if err != nil || !ok {
+			return err
+		}
+
+		err = fn(k, v)
+		if err == storage.ErrStopIteration {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Next live item of c, copied: Restore may close db while fn runs
+func (s *Store) next(db *leveldb.DB, c iterator.Iterator, bucketName []byte) ([]byte, []byte, bool, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(nil); err != nil {
+		return nil, nil, false, err
+	}
+
+	if s.db != db {
+		return nil, nil, false, storage.ErrReleased
+	}
+
+	for c.Next() {
+		v, alive := live(c.Value())
+		if !alive {
+			continue
+		}
+
+		return []byte(storage.GetRealKey(c.Key(), bucketName)), append([]byte{}, v...), true, nil
+	}
+
+	return nil, nil, false, c.Error()
+}
+
+// User value of an iterator item, false for expired or broken envelopes
+func live(data []byte) ([]byte, bool) {
+	v, err := storage.Live(data)
+
+	return v, err == nil
+}
+
+func (s *Store) KeyExist(bucketName []byte, k []byte) (bool, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return false, err
+	}
+
+	_, err := get(s.db, []byte(storage.GenerateKey(bucketName, k)))
+	if err == storage.ErrNotFound {
 		return false, nil
+	} else if err != nil {
+		return false, err
 	}
 
-	return (len(v) > 0), err
+	return true, nil
 }
 
 func (s *Store) Delete(bucketName []byte, k []byte) error {
-	if s.readOnly {
-		return errors.New("readonly mod active")
-	}
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return errors.New("unknown bucket name")
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
 	}
 
 	if len(k) == 0 {
-		return errors.New("key not found")
+		return storage.ErrEmptyKey
+	}
+
+	gkey := []byte(storage.GenerateKey(bucketName, k))
+
+	m := s.locks.For(gkey)
+	m.Lock()
+	defer m.Unlock()
+
+	return s.db.Delete(gkey, nil)
+}
+
+// All batch operations committed atomically with one leveldb batch
+func (s *Store) Write(batch *storage.Batch) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	err := s.checkBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	keys := [][]byte{}
+
+	b := new(leveldb.Batch)
+	for _, item := range batch.Items() {
+		gkey := []byte(storage.GenerateKey(item.BucketName, item.Key))
+
+		if item.Op == storage.BatchDelete {
+			b.Delete(gkey)
+		} else {
+			b.Put(gkey, storage.Wrap(item.Value, 0))
+		}
+
+		keys = append(keys, gkey)
+	}
+
+	unlock := s.locks.Lock(keys...)
+	defer unlock()
+
+	return s.db.Write(b, nil)
+}
+
+// Validate all batch items before any write
+func (s *Store) checkBatch(batch *storage.Batch) error {
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	for _, item := range batch.Items() {
+		if err := s.checkBucket(item.BucketName); err != nil {
+			return err
+		}
+
+		if len(item.Key) == 0 {
+			return storage.ErrEmptyKey
+		}
+
+		if item.Op == storage.BatchSet && len(item.Value) == 0 {
+			return storage.ErrEmptyValue
+		}
+	}
+
+	return nil
+}
+
+// Closed store and unknown bucket check
+func (s *Store) checkBucket(bucketName []byte) error {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		return storage.ErrClosed
 	}
 
-	gkey := storage.GenerateKey(bucketName, k)
+	if len(bucketName) > 0 && !s.HasBucket(bucketName) {
+		return storage.ErrUnknownBucket
+	}
+
+	return nil
+}
+
+// Same as checkBucket, also rejects writes in readonly mod
+func (s *Store) checkWrite(bucketName []byte) error {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		return storage.ErrClosed
+	}
+
+	if s.readOnly {
+		return storage.ErrReadOnly
+	}
 
-	return s.db.Delete([]byte(gkey), nil)
+	return s.checkBucket(bucketName)
 }
 
 func (s *Store) HasBucket(bucketName []byte) bool {
+	s.bucketMu.RLock()
+	defer s.bucketMu.RUnlock()
+
 	return storage.Contains(s.bucketList, bucketName)
 }
 
 func (s *Store) ListBucket() (buckets []string, err error) {
-	return s.bucketList, nil
+	if err := s.checkBucket(nil); err != nil {
+		return nil, err
+	}
+
+	s.bucketMu.RLock()
+	defer s.bucketMu.RUnlock()
+
+	return append([]string{}, s.bucketList...), nil
 }
 
 func (s *Store) DeleteBucket(bucketName []byte) error {
-	if s.readOnly {
-		return errors.New("readonly mod active")
-	}
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return errors.New("unknown bucket name")
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
 	}
 
+	return s.deleteBucket(bucketName, new(leveldb.Batch))
+}
+
+// Delete all keys of a bucket together with the operations already in batch
+func (s *Store) deleteBucket(bucketName []byte, batch *leveldb.Batch) error {
 	prefix := storage.GenerateKey(bucketName, nil)
 
 	c := s.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
 	for c.Next() {
-		// Use key/value.
-		_ = s.db.Delete(c.Key(), nil)
+		batch.Delete(c.Key())
 	}
 	c.Release()
 
-	return c.Error()
+	if err := c.Error(); err != nil {
+		return err
+	}
+
+	return s.db.Write(batch, nil)
 }
 
-func (s *Store) Backup(path, filename string) error {
-	return errors.New("not implemented")
+// Delete expired keys of all buckets. Expired keys are collected from a
+// snapshot without blocking writes, then checked again and deleted in a
+// transaction, so a key set again meanwhile is not deleted
+func (s *Store) sweep() error {
+	// Restore or CloseStore waiting
+	if !s.dbMu.TryRLock() {
+		return nil
+	}
+	defer s.dbMu.RUnlock()
+
+	keys, err := s.expiredKeys()
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	tr, err := s.db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+	defer tr.Discard()
+
+	for _, key := range keys {
+		data, err := tr.Get(key, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		_, expireAt, err := storage.Unwrap(data)
+		if err != nil || !storage.Expired(expireAt) {
+			continue
+		}
+
+		err = tr.Delete(key, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tr.Commit()
 }
 
-func (s *Store) Restore(path, filename string) error {
-	return errors.New("not implemented")
+// Copies of expired keys, read from a snapshot
+func (s *Store) expiredKeys() ([][]byte, error) {
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	keys := [][]byte{}
+
+	c := snap.NewIterator(nil, nil)
+	defer c.Release()
+
+	for c.Next() {
+		if storage.IsMetaKey(c.Key()) {
+			continue
+		}
+
+		_, expireAt, err := storage.Unwrap(c.Value())
+		if err == nil && storage.Expired(expireAt) {
+			keys = append(keys, append([]byte(nil), c.Key()...))
+		}
+	}
+
+	return keys, c.Error()
 }
@@ -0,0 +1,121 @@
+package leveldbstorage
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
+)
+
+// Store view inside Update (leveldb transaction) and View (leveldb snapshot).
+// Reads inside Update see the writes of the same transaction
+type Tx struct {
+	s  *Store
+	r  reader
+	tr *leveldb.Transaction // nil in View
+}
+
+var _ interfaces.Tx = (*Tx)(nil)
+
+// Run fn in a leveldb transaction, committed when fn returns nil and
+// discarded otherwise. Other writes wait until it ends, so fn must only
+// use tx
+func (s *Store) Update(fn func(tx interfaces.Tx) error) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tr, err := s.db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+
+	// No-op after Commit, releases the write lock when fn panics
+	defer tr.Discard()
+
+	err = fn(&Tx{s: s, r: tr, tr: tr})
+	if err != nil {
+		return err
+	}
+
+	return tr.Commit()
+}
+
+// Run fn on a leveldb snapshot, writes return storage.ErrReadOnly. fn must
+// only use tx, a Restore waiting meanwhile blocks store calls
+func (s *Store) View(fn func(tx interfaces.Tx) error) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(nil); err != nil {
+		return err
+	}
+
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	return fn(&Tx{s: s, r: snap})
+}
+
+func (tx *Tx) Get(bucketName []byte, k []byte) ([]byte, error) {
+	if err := tx.s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	return get(tx.r, []byte(storage.GenerateKey(bucketName, k)))
+}
+
+func (tx *Tx) Set(bucketName []byte, k []byte, v []byte) error {
+	if err := tx.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	if len(v) == 0 {
+		return storage.ErrEmptyValue
+	}
+
+	return tx.tr.Put([]byte(storage.GenerateKey(bucketName, k)), storage.Wrap(v, 0), nil)
+}
+
+func (tx *Tx) Delete(bucketName []byte, k []byte) error {
+	if err := tx.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	return tx.tr.Delete([]byte(storage.GenerateKey(bucketName, k)), nil)
+}
+
+// order by asc
+func (tx *Tx) List(bucketName []byte, k []byte, perpage int) ([]string, error) {
+	if err := tx.s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	items, err := listKV(tx.r, bucketName, k, perpage)
+
+	return storage.Values(items), err
+}
+
+func (tx *Tx) checkWrite(bucketName []byte) error {
+	if tx.tr == nil {
+		return storage.ErrReadOnly
+	}
+
+	return tx.s.checkWrite(bucketName)
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Number of mutexes in KeyLocks
+const lockStripes = 256
+
+// Fixed set of mutexes picked by key hash. Writes of a key hold its mutex,
+// so read-modify-write operations (Incr, CompareAndSwap etc.) of a key are
+// atomic against other writes of it, while other keys stay writable
+type KeyLocks struct {
+	stripes [lockStripes]sync.Mutex
+}
+
+// Mutex of a db key, different keys may share one
+func (l *KeyLocks) For(key []byte) *sync.Mutex {
+	return &l.stripes[stripe(key)]
+}
+
+// Lock the mutexes of all keys, each one once and in stripe order, so calls
+// locking several keys never wait on each other. Returns the unlock function
+func (l *KeyLocks) Lock(keys ...[]byte) func() {
+	var used [lockStripes]bool
+	for _, key := range keys {
+		used[stripe(key)] = true
+	}
+
+	locked := []*sync.Mutex{}
+	for i := range used {
+		if used[i] {
+			l.stripes[i].Lock()
+			locked = append(locked, &l.stripes[i])
+		}
+	}
+
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			locked[i].Unlock()
+		}
+	}
+}
+
+func stripe(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+
+	return h.Sum32() % lockStripes
+}
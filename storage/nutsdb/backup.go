@@ -0,0 +1,158 @@
+package nutsdbstorage
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/uretgec/mylsmdb/storage"
+)
+
+// Write the nutsdb data folder as a tar.gz file (db.BackupTarGZ) to
+// path/filename. Taken in a read transaction, writers wait until it is done
+func (s *Store) Backup(path, filename string) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(nil); err != nil {
+		return err
+	}
+
+	return storage.CreateFile(path, filename, s.db.BackupTarGZ)
+}
+
+// Replace the db with a Backup file. The file is extracted into a new
+// folder next to the db while the store keeps serving calls. Then open
+// snapshots are released, running calls waited for, the db closed, its folder
+// replaced and opened again with the same options; calls made meanwhile
+// wait for it. Buckets created after NewStore come from the restored
+// catalog. The store is closed when no db can be opened again
+func (s *Store) Restore(path, filename string) error {
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(s.dir), filepath.Base(s.dir)+".restore")
+	if err != nil {
+		return err
+	}
+
+	err = restoreTarGZ(dir, storage.ArchivePath(path, filename))
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	// Writers blocked by open snapshots would keep the swap waiting
+	done := s.releaseSnapshots()
+	defer done()
+
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	s.sweeper.Stop()
+	s.sweeper = nil
+
+	err = s.db.Close()
+	if err == nil {
+		err = storage.SwapDir(s.dir, dir)
+	}
+
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+
+	// Reopen the restored db, or the old one when the swap failed
+	if oerr := s.open(); oerr != nil {
+		atomic.StoreInt32(&s.closed, 1)
+
+		if err == nil {
+			err = oerr
+		}
+	}
+
+	return err
+}
+
+// Extract a BackupTarGZ file into the empty folder dir. Entries are named
+// after the backed up folder ("<folder>/<file>"), the folder name is dropped
+func restoreTarGZ(dir, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return storage.ErrInvalidArchive
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return storage.ErrInvalidArchive
+		}
+
+		name := filepath.Clean(header.Name)
+		if i := strings.IndexByte(name, filepath.Separator); i >= 0 {
+			name = name[i+1:]
+		} else {
+			// Backed up folder itself
+			continue
+		}
+
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return storage.ErrInvalidArchive
+		}
+
+		target := filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = extractFile(target, tr, os.FileMode(header.Mode).Perm())
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractFile(target string, r io.Reader, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
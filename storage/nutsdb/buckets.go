@@ -0,0 +1,133 @@
+package nutsdbstorage
+
+import (
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/xujiajun/nutsdb"
+)
+
+// Merge the bucket catalog saved in the metadata bucket with the bucket list
+// given to NewStore, and save the new ones
+func (s *Store) loadBuckets() error {
+	for _, b := range s.bucketList {
+		if err := storage.ValidBucketName([]byte(b)); err != nil {
+			return err
+		}
+	}
+
+	err := s.db.View(func(t *nutsdb.Tx) error {
+		entries, err := t.GetAll(string(storage.MetaBucket))
+		if err == nutsdb.ErrBucketEmpty {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if !storage.Contains(s.bucketList, e.Key) {
+				s.bucketList = append(s.bucketList, string(e.Key))
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil || s.readOnly {
+		return err
+	}
+
+	return s.db.Update(func(t *nutsdb.Tx) error {
+		for _, b := range s.bucketList {
+			err := t.Put(string(storage.MetaBucket), []byte(b), []byte("1"), 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Add a bucket at runtime, saved in the bucket catalog.
+// Creating an existing bucket is not an error
+func (s *Store) CreateBucket(bucketName []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	if err := storage.ValidBucketName(bucketName); err != nil {
+		return err
+	}
+
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+
+	if storage.Contains(s.bucketList, bucketName) {
+		return nil
+	}
+
+	err := s.db.Update(func(t *nutsdb.Tx) error {
+		return t.Put(string(storage.MetaBucket), bucketName, []byte("1"), 0)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	s.bucketList = append(s.bucketList, string(bucketName))
+	return nil
+}
+
+// Delete a bucket with all keys and its sequence, and remove it from the bucket
+// catalog in one transaction. Holds the write lock, so no write reaches the
+// bucket while its keys are deleted
+func (s *Store) DropBucket(bucketName []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	if err := storage.ValidBucketName(bucketName); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Not held during the transaction, Update closures read the bucket list
+	s.bucketMu.Lock()
+	if !storage.Contains(s.bucketList, bucketName) {
+		s.bucketMu.Unlock()
+		return storage.ErrUnknownBucket
+	}
+
+	s.bucketList = storage.Remove(s.bucketList, bucketName)
+	s.bucketMu.Unlock()
+
+	err := s.db.Update(func(t *nutsdb.Tx) error {
+		err := s.deleteBucket(t, bucketName)
+		if err != nil {
+			return err
+		}
+
+		err = t.Delete(sequenceBucket, sequenceKey(bucketName))
+		if err != nil {
+			return err
+		}
+
+		return t.Delete(string(storage.MetaBucket), bucketName)
+	})
+
+	if err != nil {
+		// Nothing deleted, bucket still in the catalog
+		s.bucketMu.Lock()
+		s.bucketList = append(s.bucketList, string(bucketName))
+		s.bucketMu.Unlock()
+	}
+
+	return err
+}
@@ -0,0 +1,111 @@
+package nutsdbstorage
+
+import (
+	"bytes"
+
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/xujiajun/nutsdb"
+)
+
+// Conditional writes read and write a key in one transaction. A
+// *storage.ConflictError is returned when the stored value does not match
+
+// Replace the value of a key only if it is oldValue, key ttl kept
+func (s *Store) CompareAndSwap(bucketName []byte, k []byte, oldValue []byte, newValue []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	if len(newValue) == 0 {
+		return storage.ErrEmptyValue
+	}
+
+	return s.db.Update(func(t *nutsdb.Tx) error {
+		rxData, err := t.Get(string(bucketName), k)
+		if isNotFound(err) {
+			return &storage.ConflictError{BucketName: bucketName, Key: k}
+		} else if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(rxData.Value, oldValue) {
+			return &storage.ConflictError{BucketName: bucketName, Key: k, Current: rxData.Value}
+		}
+
+		return t.Put(string(bucketName), k, newValue, remainingTTL(rxData))
+	})
+}
+
+// Set the value of a key only if it is missing (or expired)
+func (s *Store) SetIfAbsent(bucketName []byte, k []byte, v []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	if len(v) == 0 {
+		return storage.ErrEmptyValue
+	}
+
+	return s.db.Update(func(t *nutsdb.Tx) error {
+		rxData, err := t.Get(string(bucketName), k)
+		if err == nil {
+			return &storage.ConflictError{BucketName: bucketName, Key: k, Current: rxData.Value}
+		} else if !isNotFound(err) {
+			return err
+		}
+
+		return t.Put(string(bucketName), k, v, nutsdb.Persistent)
+	})
+}
+
+// Delete a key only if its value is v
+func (s *Store) DeleteIfEquals(bucketName []byte, k []byte, v []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	return s.db.Update(func(t *nutsdb.Tx) error {
+		rxData, err := t.Get(string(bucketName), k)
+		if isNotFound(err) {
+			return &storage.ConflictError{BucketName: bucketName, Key: k}
+		} else if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(rxData.Value, v) {
+			return &storage.ConflictError{BucketName: bucketName, Key: k, Current: rxData.Value}
+		}
+
+		return t.Delete(string(bucketName), k)
+	})
+}
@@ -0,0 +1,87 @@
+package nutsdbstorage
+
+import (
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/xujiajun/nutsdb"
+)
+
+// Reserved nutsdb bucket of bucket sequences, key is the bucket name
+var sequenceBucket = string(storage.MetaBucket) + ":sequence"
+
+// Next value (starting from 1) of the bucket sequence, saved in a reserved
+// bucket. Values are never reused, DropBucket resets the sequence
+func (s *Store) NextSequence(bucketName []byte) (uint64, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	err := s.db.Update(func(t *nutsdb.Tx) error {
+		var v []byte
+
+		rxData, err := t.Get(sequenceBucket, sequenceKey(bucketName))
+		if err == nil {
+			v = rxData.Value
+		} else if !isNotFound(err) {
+			return err
+		}
+
+		n, err = storage.Incr(v, 1)
+		if err != nil {
+			return err
+		}
+
+		return t.Put(sequenceBucket, sequenceKey(bucketName), storage.U64tob(int(n)), nutsdb.Persistent)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(n), nil
+}
+
+// Nutsdb keys can not be empty, no bucket uses the bare prefix
+func sequenceKey(bucketName []byte) []byte {
+	return append([]byte("sequence:"), bucketName...)
+}
+
+// Save v under the next bucket sequence (storage.U64tob), so List returns
+// appended values in insertion order. Returns the sequence
+func (s *Store) Append(bucketName []byte, v []byte) (uint64, error) {
+	if len(v) == 0 {
+		return 0, storage.ErrEmptyValue
+	}
+
+	seq, err := s.NextSequence(bucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = s.Set(bucketName, storage.U64tob(int(seq)), v)
+
+	return seq, err
+}
+
+// Save v under a new snowflake id (storage.U64tob). Ids are time ordered and
+// unique across processes opened with different storage.WithNodeID. Returns the id
+func (s *Store) Insert(bucketName []byte, v []byte) (int64, error) {
+	if len(v) == 0 {
+		return 0, storage.ErrEmptyValue
+	}
+
+	id := s.node.Generate().Int64()
+
+	_, err := s.Set(bucketName, storage.U64tob(int(id)), v)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
@@ -0,0 +1,217 @@
+package nutsdbstorage
+
+import (
+	"sync"
+
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
+	"github.com/xujiajun/nutsdb"
+)
+
+// Read-only view of the db backed by a nutsdb read transaction. The
+// transaction holds the db read lock, so writes wait until Release: keep
+// snapshots short and never write from the goroutine holding one. Restore
+// and CloseStore release it, later calls return storage.ErrReleased
+type Snapshot struct {
+	s  *Store
+	db *nutsdb.DB
+
+	// Guards tx against a rollback by Restore or CloseStore
+	mu       sync.Mutex
+	tx       *nutsdb.Tx
+	released bool
+}
+
+var _ interfaces.Snapshot = (*Snapshot)(nil)
+
+func (s *Store) Snapshot() (interfaces.Snapshot, error) {
+	sn, err := s.newSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return sn, nil
+}
+
+func (s *Store) newSnapshot() (*Snapshot, error) {
+	for {
+		sn, err := s.snapshot()
+		if sn != nil || err != nil {
+			return sn, err
+		}
+	}
+}
+
+// Open and register a snapshot, nil while CloseStore or Restore release them
+func (s *Store) snapshot() (*Snapshot, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(nil); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	if s.swaps > 0 {
+		// Would block the swap, try again once it is done
+		_ = tx.Rollback()
+		return nil, nil
+	}
+
+	sn := &Snapshot{s: s, db: s.db, tx: tx}
+	s.snaps[sn] = struct{}{}
+
+	return sn, nil
+}
+
+// Roll back the read transactions of open snapshots and refuse new ones
+// until done is called. Snapshot calls do not take dbMu, so it may be held
+func (s *Store) releaseSnapshots() (done func()) {
+	s.snapMu.Lock()
+	snaps := s.snaps
+	s.snaps = make(map[*Snapshot]struct{})
+	s.swaps++
+	s.snapMu.Unlock()
+
+	for sn := range snaps {
+		sn.rollback()
+	}
+
+	return func() {
+		s.snapMu.Lock()
+		s.swaps--
+		s.snapMu.Unlock()
+	}
+}
+
+func (sn *Snapshot) Get(bucketName []byte, k []byte) ([]byte, error) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	if err := sn.check(bucketName); err != nil {
+		return nil, err
+	}
+
+	return get(sn.tx, bucketName, k)
+}
+
+func (sn *Snapshot) MGet(bucketName []byte, keys ...[]byte) (map[string]interface{}, error) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	if err := sn.check(bucketName); err != nil {
+		return nil, err
+	}
+
+	return mget(sn.tx, bucketName, keys), nil
+}
+
+// order by asc
+func (sn *Snapshot) List(bucketName []byte, k []byte, perpage int) ([]string, error) {
+	items, err := sn.listKV(bucketName, k, perpage)
+
+	return storage.Values(items), err
+}
+
+// Same as Store.ForEach, fn runs without sn.mu
+func (sn *Snapshot) ForEach(bucketName []byte, fn func(k, v []byte) error) error {
+	c, err := sn.iterator(bucketName)
+	if err != nil || c == nil {
+		return err
+	}
+
+	for {
+		k, v, ok, err := sn.next(c)
+		if err != nil || !ok {
+			return err
+		}
+
+		err = fn(k, v)
+		if err == storage.ErrStopIteration {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Iterator of a bucket, nil when it is empty
+func (sn *Snapshot) iterator(bucketName []byte) (*nutsdb.Iterator, error) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	if err := sn.check(bucketName); err != nil {
+		return nil, err
+	}
+
+	// when bucket is empty and call c.SetNext, boom
+	if sn.s.statsBucket(sn.db, bucketName) == 0 {
+		return nil, nil
+	}
+
+	return nutsdb.NewIterator(sn.tx, string(bucketName)), nil
+}
+
+// Next item of c, entries are read from the data files so they stay valid
+// after a rollback
+func (sn *Snapshot) next(c *nutsdb.Iterator) ([]byte, []byte, bool, error) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	if sn.released {
+		return nil, nil, false, storage.ErrReleased
+	}
+
+	ok, err := c.SetNext()
+	if err != nil || !ok {
+		return nil, nil, false, err
+	}
+
+	return c.Entry().Key, c.Entry().Value, true, nil
+}
+
+func (sn *Snapshot) listKV(bucketName []byte, k []byte, perpage int) ([]storage.KV, error) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	if err := sn.check(bucketName); err != nil {
+		return nil, err
+	}
+
+	return sn.s.listKV(sn.db, sn.tx, bucketName, k, perpage)
+}
+
+// Roll back the read transaction, safe to call more than once
+func (sn *Snapshot) Release() {
+	sn.s.snapMu.Lock()
+	delete(sn.s.snaps, sn)
+	sn.s.snapMu.Unlock()
+
+	sn.rollback()
+}
+
+func (sn *Snapshot) rollback() {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+
+	if !sn.released {
+		sn.released = true
+		_ = sn.tx.Rollback()
+	}
+}
+
+// Released snapshot, closed store and unknown bucket check, sn.mu must be held
+func (sn *Snapshot) check(bucketName []byte) error {
+	if sn.released {
+		return storage.ErrReleased
+	}
+
+	return sn.s.checkBucket(bucketName)
+}
@@ -3,28 +3,76 @@ package nutsdbstorage
 import (
 	"bytes"
 	"errors"
-	"fmt"
-	"strings"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/bwmarrin/snowflake"
 	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
 	"github.com/xujiajun/nutsdb"
 )
 
 type Store struct {
 	db         *nutsdb.DB
+	dir        string
+	options    storage.Options
+	bucketMu   sync.RWMutex
 	bucketList []string
+	buckets    []string // bucket list given to NewStore
 	readOnly   bool
+	closed     int32
+	sweeper    *storage.Sweeper
+	node       *snowflake.Node
+
+	// Every call holds it shared while it uses db. Restore and CloseStore
+	// hold it alone to swap or close it. Taken before mu
+	dbMu sync.RWMutex
+
+	// Writes share it from their bucket check to the commit, DropBucket
+	// holds it alone, so no write lands in a dropped bucket
+	mu sync.RWMutex
+
+	// Open snapshots, their read transactions block writers and db.Close.
+	// swaps counts CloseStore and Restore calls releasing them
+	snapMu sync.Mutex
+	snaps  map[*Snapshot]struct{}
+	swaps  int
 }
 
-func NewStore(bucketList []string, path string, dbFolder string, readOnly bool) (*Store, error) {
+var _ interfaces.Storage = (*Store)(nil)
+
+func NewStore(bucketList []string, path string, dbFolder string, readOnly bool, opts ...storage.Option) (*Store, error) {
 	s := &Store{}
-	s.bucketList = bucketList
+	s.snaps = make(map[*Snapshot]struct{})
+	s.buckets = append([]string{}, bucketList...)
 	s.readOnly = readOnly
+	s.options = storage.NewOptions(opts...)
+	// Clean path, BackupTarGZ names files relative to it
+	s.dir = filepath.Join(path, dbFolder)
+
+	// Insert id generator
+	node, err := snowflake.NewNode(s.options.NodeID)
+	if err != nil {
+		return s, err
+	}
+
+	s.node = node
 
 	// Create dir if not exist
 	_ = storage.CreateDir(path)
 
-	// Open DB
+	err = s.open()
+	if err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// Open DB folder, load the bucket catalog and start the sweeper
+func (s *Store) open() error {
 	db, err := nutsdb.Open(
 		nutsdb.Options{
 			EntryIdxMode:         nutsdb.HintKeyAndRAMIdxMode,
@@ -34,17 +82,49 @@ func NewStore(bucketList []string, path string, dbFolder string, readOnly bool)
 			SyncEnable:           true,
 			StartFileLoadingMode: nutsdb.FileIO,
 		},
-		nutsdb.WithDir(fmt.Sprintf("%s/%s", strings.TrimSuffix(path, "/"), dbFolder)),
+		nutsdb.WithDir(s.dir),
 	)
 	if err != nil {
-		return s, err
+		return err
 	}
 
 	s.db = db
-	return s, nil
+	s.bucketMu.Lock()
+	s.bucketList = append([]string{}, s.buckets...)
+
+	err = s.loadBuckets()
+	s.bucketMu.Unlock()
+
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	if !s.readOnly {
+		s.sweeper = storage.NewSweeper(s.options.SweepInterval, func() {
+			_ = s.sweep()
+		})
+	}
+
+	return nil
 }
 
+// Releases open snapshots, then waits for running calls
 func (s *Store) CloseStore() error {
+	// Writers waiting for their read transactions would block dbMu
+	done := s.releaseSnapshots()
+	defer done()
+
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return storage.ErrClosed
+	}
+
+	s.sweeper.Stop()
+	s.sweeper = nil
+
 	return s.db.Close()
 }
 
@@ -53,73 +133,229 @@ func (s *Store) SyncStore() {
 }
 
 func (s *Store) Set(bucketName []byte, k []byte, v []byte) ([]byte, error) {
-	if s.readOnly {
-		return nil, errors.New("readonly mod active")
+	return s.SetWithTTL(bucketName, k, v, 0)
+}
+
+// Key expires after ttl, ttl <= 0 means no expiry. Nutsdb ttl is in
+// seconds, so ttl rounded up to a full second
+func (s *Store) SetWithTTL(bucketName []byte, k []byte, v []byte, ttl time.Duration) ([]byte, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return nil, err
 	}
 
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	if len(k) == 0 {
+		return nil, storage.ErrEmptyKey
 	}
 
-	if len(k) == 0 || len(v) == 0 {
-		return nil, errors.New("key or value not found")
+	if len(v) == 0 {
+		return nil, storage.ErrEmptyValue
 	}
 
 	err := s.db.Update(func(t *nutsdb.Tx) error {
-		return t.Put(string(bucketName), k, v, 0)
+		return t.Put(string(bucketName), k, v, ttlSeconds(ttl))
 	})
 
 	return k, err
 }
 
-// TODO
-func (s *Store) MSet(bucketName []byte, k []byte, v []byte) ([]byte, error) {
-	return []byte(""), errors.New("not implemented")
+// All items written atomically in one transaction
+func (s *Store) MSet(bucketName []byte, items ...storage.KV) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if len(item.Key) == 0 {
+			return storage.ErrEmptyKey
+		}
+
+		if len(item.Value) == 0 {
+			return storage.ErrEmptyValue
+		}
+	}
+
+	return s.db.Update(func(t *nutsdb.Tx) error {
+		for _, item := range items {
+			err := t.Put(string(bucketName), []byte(item.Key), []byte(item.Value), 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
 func (s *Store) Get(bucketName []byte, k []byte) ([]byte, error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
 	}
 
 	var item []byte
+	err := s.db.View(func(t *nutsdb.Tx) (err error) {
+		item, err = get(t, bucketName, k)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func get(t *nutsdb.Tx, bucketName []byte, k []byte) ([]byte, error) {
+	rxData, err := t.Get(string(bucketName), k)
+	if isNotFound(err) {
+		return nil, storage.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Present but empty value is not nil
+	if rxData.Value == nil {
+		return []byte{}, nil
+	}
+
+	return rxData.Value, nil
+}
+
+// Nutsdb ttl of a duration, 0 (nutsdb.Persistent) for ttl <= 0
+func ttlSeconds(ttl time.Duration) uint32 {
+	if ttl <= 0 {
+		return nutsdb.Persistent
+	}
+
+	return uint32((ttl + time.Second - 1) / time.Second)
+}
+
+// Remaining time to live of a key, storage.NoTTL for keys without expiry
+func (s *Store) TTL(bucketName []byte, k []byte) (time.Duration, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return 0, err
+	}
+
+	var ttl time.Duration
 	err := s.db.View(func(t *nutsdb.Tx) error {
 		rxData, err := t.Get(string(bucketName), k)
-		if err == nutsdb.ErrNotFoundKey {
-			return nil
+		if isNotFound(err) {
+			return storage.ErrNotFound
 		} else if err != nil {
 			return err
 		}
 
-		if len(rxData.Value) > 0 {
-			item = rxData.Value
+		// Get skips expired keys
+		ttl = storage.NoTTL
+		if rxData.Meta.TTL != nutsdb.Persistent {
+			expireAt := time.Unix(int64(rxData.Meta.Timestamp)+int64(rxData.Meta.TTL), 0)
+			ttl = storage.Remaining(expireAt.UnixNano())
 		}
 
 		return nil
 	})
 
-	return item, err
+	return ttl, err
 }
 
-func (s *Store) MGet(bucketName []byte, keys ...[]byte) (list map[string]interface{}, err error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
+// Missing key and missing bucket both mean not found
+func isNotFound(err error) bool {
+	return errors.Is(err, nutsdb.ErrNotFoundKey) ||
+		errors.Is(err, nutsdb.ErrKeyNotFound) ||
+		errors.Is(err, nutsdb.ErrBucketNotFound)
+}
+
+// Add delta to the counter of a key and return the new value in one
+// transaction. Missing key counts from 0, key ttl kept
+func (s *Store) Incr(bucketName []byte, k []byte, delta int64) (int64, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return 0, err
 	}
 
-	items := make(map[string]interface{})
+	if len(k) == 0 {
+		return 0, storage.ErrEmptyKey
+	}
 
-	err = s.db.View(func(t *nutsdb.Tx) error {
-		for _, key := range keys {
-			rxData, err := t.Get(string(bucketName), key)
-			if err == nutsdb.ErrNotFoundKey {
-				continue
-			} else if err != nil {
-				continue
-			}
+	var n int64
+	err := s.db.Update(func(t *nutsdb.Tx) error {
+		var v []byte
+		var ttl uint32
+
+		rxData, err := t.Get(string(bucketName), k)
+		if err == nil {
+			v, ttl = rxData.Value, remainingTTL(rxData)
+		} else if !isNotFound(err) {
+			return err
+		}
 
-			items[string(key)] = string(rxData.Value)
+		n, err = storage.Incr(v, delta)
+		if err != nil {
+			return err
 		}
 
+		return t.Put(string(bucketName), k, storage.U64tob(int(n)), ttl)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Same as Incr with -delta
+func (s *Store) Decr(bucketName []byte, k []byte, delta int64) (int64, error) {
+	return s.Incr(bucketName, k, -delta)
+}
+
+// Nutsdb ttl left of an entry, used to keep the expiry on rewrite
+func remainingTTL(e *nutsdb.Entry) uint32 {
+	if e.Meta.TTL == nutsdb.Persistent {
+		return nutsdb.Persistent
+	}
+
+	left := int64(e.Meta.Timestamp) + int64(e.Meta.TTL) - time.Now().Unix()
+	if left < 1 {
+		left = 1
+	}
+
+	return uint32(left)
+}
+
+func (s *Store) MGet(bucketName []byte, keys ...[]byte) (list map[string]interface{}, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	var items map[string]interface{}
+	err = s.db.View(func(t *nutsdb.Tx) error {
+		items = mget(t, bucketName, keys)
 		return nil
 	})
 
@@ -130,30 +366,70 @@ func (s *Store) MGet(bucketName []byte, keys ...[]byte) (list map[string]interfa
 	return items, nil
 }
 
+// Values of found keys
+func mget(t *nutsdb.Tx, bucketName []byte, keys [][]byte) map[string]interface{} {
+	items := make(map[string]interface{})
+
+	for _, key := range keys {
+		rxData, err := t.Get(string(bucketName), key)
+		if err != nil {
+			continue
+		}
+
+		items[string(key)] = string(rxData.Value)
+	}
+
+	return items
+}
+
 // order by asc
 func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, err error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
-	}
+	items, err := s.ListKV(bucketName, k, perpage)
 
-	//return []string{fmt.Sprintf("%d", s.statsBucket(bucketName))}, nil
-	// line 162 - when bucket is empty and call c.SetNext, boom. its huge bug!
-	if s.statsBucket(bucketName) == 0 {
-		return nil, nil
-	}
+	return storage.Values(items), err
+}
 
-	counter := 1
+// order by desc
+func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []string, err error) {
+	items, err := s.PrevListKV(bucketName, k, perpage)
+
+	return storage.Values(items), err
+}
 
-	items := []string{}
+// order by asc, keys with values
+func (s *Store) ListKV(bucketName []byte, k []byte, perpage int) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	err = s.db.View(func(t *nutsdb.Tx) (err error) {
+		list, err = s.listKV(s.db, t, bucketName, k, perpage)
+		return err
+	})
 
-	tx, err := s.db.Begin(true)
 	if err != nil {
 		return nil, err
 	}
 
-	c := nutsdb.NewIterator(tx, string(bucketName))
+	return list, nil
+}
+
+func (s *Store) listKV(db *nutsdb.DB, t *nutsdb.Tx, bucketName []byte, k []byte, perpage int) ([]storage.KV, error) {
+	// when bucket is empty and call c.SetNext, boom. its huge bug!
+	if s.statsBucket(db, bucketName) == 0 {
+		return nil, nil
+	}
+
+	counter := 1
+
+	items := []storage.KV{}
+
+	c := nutsdb.NewIterator(t, string(bucketName))
 	if len(k) > 0 {
-		err = c.Seek(k)
+		err := c.Seek(k)
 		if err != nil {
 			return nil, err
 		}
@@ -161,12 +437,11 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 
 	for {
 		ok, err := c.SetNext()
-		if !ok {
-			err = nil
-			break
+		if err != nil {
+			return nil, err
 		}
 
-		if err != nil {
+		if !ok {
 			break
 		}
 
@@ -174,7 +449,7 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 			continue
 		}
 
-		items = append(items, string(c.Entry().Value))
+		items = append(items, storage.KV{Key: string(c.Entry().Key), Value: string(c.Entry().Value)})
 
 		if counter >= perpage {
 			break
@@ -183,46 +458,299 @@ func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, e
 		counter++
 	}
 
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	return items, nil
+}
+
+// order by desc, keys with values
+func (s *Store) PrevListKV(bucketName []byte, k []byte, perpage int) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	// At least one key, same as List
+	if perpage < 1 {
+		perpage = 1
+	}
+
+	items := []storage.KV{}
+
+	err = s.db.View(func(t *nutsdb.Tx) error {
+		// Same empty bucket guard as List
+		if s.statsBucket(s.db, bucketName) == 0 {
+			return nil
+		}
+
+		idx, ok := s.db.BPTreeIdx[string(bucketName)]
+		if !ok {
+			return nil
+		}
+
+		end := idx.LastKey
+		if len(k) > 0 {
+			end = k
+		}
+
+		var err error
+		prevRecords(idx, end, func(key []byte) bool {
+			if bytes.Equal(k, key) {
+				return true
+			}
+
+			rxData, gerr := t.Get(string(bucketName), key)
+			if isNotFound(gerr) {
+				return true
+			} else if gerr != nil {
+				err = gerr
+				return false
+			}
+
+			items = append(items, storage.KV{Key: string(key), Value: string(rxData.Value)})
+
+			return len(items) < perpage
+		})
+
+		return err
+	})
+
 	if err != nil {
 		return nil, err
 	}
 
-	err = tx.Commit()
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	return items, nil
+}
+
+// Call fn for the keys up to end (deleted ones included) order by desc until
+// it returns false. The B+tree has no reverse iterator, so it is read leaf by
+// leaf: the leaf before a key is found with a key just before it, and Range
+// from that leaf also covers any leaf the probe skipped
+func prevRecords(idx *nutsdb.BPTree, end []byte, fn func(key []byte) bool) {
+	inclusive := true
+
+	leaf := idx.FindLeaf(end)
+	for leaf != nil && leaf.KeysNum > 0 {
+		first := leaf.Keys[0]
+
+		records, err := idx.Range(first, end)
+		if err == nil {
+			for i := len(records) - 1; i >= 0; i-- {
+				key := records[i].H.Key
+				if !inclusive && bytes.Equal(key, end) {
+					continue
+				}
+
+				if !fn(key) {
+					return
+				}
+			}
+		}
+
+		probe, ok := before(first)
+		if !ok {
+			return
+		}
+
+		leaf = idx.FindLeaf(probe)
+		if leaf == nil || leaf.KeysNum == 0 || bytes.Compare(leaf.Keys[0], first) >= 0 {
+			// First leaf
+			return
+		}
+
+		end, inclusive = first, false
+	}
+}
+
+// A key just before k, false for the empty key. Exact when k ends with a
+// zero byte, else followed by 0xff bytes so only keys sharing that long
+// prefix are after it
+func before(k []byte) ([]byte, bool) {
+	n := len(k)
+	if n == 0 {
+		return nil, false
+	}
+
+	if k[n-1] == 0 {
+		return k[:n-1], true
+	}
+
+	probe := append(append([]byte{}, k[:n-1]...), k[n-1]-1)
+
+	return append(probe, bytes.Repeat([]byte{0xff}, 16)...), true
+}
+
+// order by asc, one page with cursors
+func (s *Store) ListPage(bucketName []byte, cursor string, perpage int) (*storage.Page, error) {
+	return storage.ListPage(func(k []byte, n int) ([]storage.KV, error) {
+		return s.ListKV(bucketName, k, n)
+	}, cursor, perpage)
+}
+
+// order by desc, one page with cursors
+func (s *Store) PrevListPage(bucketName []byte, cursor string, perpage int) (*storage.Page, error) {
+	return storage.ListPage(func(k []byte, n int) ([]storage.KV, error) {
+		return s.PrevListKV(bucketName, k, n)
+	}, cursor, perpage)
+}
+
+// Keys between start and end (inclusive unless opts say otherwise), via RangeScan
+func (s *Store) Range(bucketName []byte, start []byte, end []byte, opts storage.RangeOptions) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	items := []storage.KV{}
+
+	err = s.db.View(func(t *nutsdb.Tx) error {
+		if s.statsBucket(s.db, bucketName) == 0 {
+			return nil
+		}
+
+		idx, ok := s.db.BPTreeIdx[string(bucketName)]
+		if !ok {
+			return nil
+		}
+
+		first, last := start, end
+		if len(first) == 0 {
+			first = idx.FirstKey
+		}
+
+		if len(last) == 0 {
+			last = idx.LastKey
+		}
+
+		entries, err := t.RangeScan(string(bucketName), first, last)
+		if err == nutsdb.ErrRangeScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// RangeScan is inclusive and order by asc
+		for i := range entries {
+			e := entries[i]
+			if opts.Reverse {
+				e = entries[len(entries)-1-i]
+			}
+
+			if opts.Full(len(items)) {
+				break
+			}
+
+			if !opts.InRange(e.Key, start, end) {
+				continue
+			}
+
+			items = append(items, storage.KV{Key: string(e.Key), Value: string(e.Value)})
+		}
+
+		return nil
+	})
+
 	if err != nil {
 		return nil, err
 	}
 
 	if len(items) == 0 {
+		return nil, nil
+	}
+
+	return items, nil
+}
+
+// Keys starting with prefix in a bucket, limit 0 means no limit
+func (s *Store) PrefixScan(bucketName []byte, prefix []byte, limit int) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	items := []storage.KV{}
+
+	err = s.db.View(func(t *nutsdb.Tx) error {
+		if s.statsBucket(s.db, bucketName) == 0 {
+			return nil
+		}
+
+		// Nutsdb counts deleted and expired keys toward its limit before
+		// dropping them, so scan without limit and stop here
+		entries, _, err := t.PrefixScan(string(bucketName), prefix, 0, nutsdb.ScanNoLimit)
+		if err == nutsdb.ErrPrefixScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if limit > 0 && len(items) >= limit {
+				break
+			}
+
+			items = append(items, storage.KV{Key: string(e.Key), Value: string(e.Value)})
+		}
+
+		return nil
+	})
+
+	if err != nil {
 		return nil, err
 	}
 
-	return items, err
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	return items, nil
 }
 
-func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []string, err error) {
-	return nil, errors.New("not implemented")
+// Call fn for every key of a bucket order by asc, without loading the bucket
+// in memory. k and v are only valid during the call. fn may return
+// storage.ErrStopIteration to stop early. It runs in a read transaction,
+// so fn must not write to the store. Restore and CloseStore roll it back
+// without waiting for fn, ending it with storage.ErrReleased
+func (s *Store) ForEach(bucketName []byte, fn func(k, v []byte) error) error {
+	sn, err := s.newSnapshot()
+	if err != nil {
+		return err
+	}
+	defer sn.Release()
+
+	return sn.ForEach(bucketName, fn)
 }
 
 func (s *Store) KeyExist(bucketName []byte, k []byte) (bool, error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return false, errors.New("unknown bucket name")
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return false, err
 	}
 
 	var exists bool
 	err := s.db.View(func(t *nutsdb.Tx) error {
-		rxData, err := t.Get(string(bucketName), k)
-		if err == nutsdb.ErrNotFoundKey {
-			return nil
-		} else if err == nutsdb.ErrKeyNotFound {
+		_, err := t.Get(string(bucketName), k)
+		if isNotFound(err) {
 			return nil
 		} else if err != nil {
 			return err
 		}
 
-		if len(rxData.Value) > 0 {
-			exists = true
-		}
-
+		exists = true
 		return nil
 	})
 
@@ -230,16 +758,18 @@ func (s *Store) KeyExist(bucketName []byte, k []byte) (bool, error) {
 }
 
 func (s *Store) Delete(bucketName []byte, k []byte) error {
-	if s.readOnly {
-		return errors.New("readonly mod active")
-	}
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return errors.New("unknown bucket name")
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
 	}
 
 	if len(k) == 0 {
-		return errors.New("key not found")
+		return storage.ErrEmptyKey
 	}
 
 	return s.db.Update(func(t *nutsdb.Tx) error {
@@ -247,16 +777,99 @@ func (s *Store) Delete(bucketName []byte, k []byte) error {
 	})
 }
 
+// All batch operations committed atomically in one transaction
+func (s *Store) Write(batch *storage.Batch) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	err := s.checkBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(t *nutsdb.Tx) error {
+		for _, item := range batch.Items() {
+			var err error
+			if item.Op == storage.BatchDelete {
+				err = t.Delete(string(item.BucketName), item.Key)
+			} else {
+				err = t.Put(string(item.BucketName), item.Key, item.Value, 0)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Validate all batch items before any write
+func (s *Store) checkBatch(batch *storage.Batch) error {
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	for _, item := range batch.Items() {
+		if err := s.checkBucket(item.BucketName); err != nil {
+			return err
+		}
+
+		if len(item.Key) == 0 {
+			return storage.ErrEmptyKey
+		}
+
+		if item.Op == storage.BatchSet && len(item.Value) == 0 {
+			return storage.ErrEmptyValue
+		}
+	}
+
+	return nil
+}
+
+// Closed store and unknown bucket check
+func (s *Store) checkBucket(bucketName []byte) error {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		return storage.ErrClosed
+	}
+
+	if len(bucketName) > 0 && !s.HasBucket(bucketName) {
+		return storage.ErrUnknownBucket
+	}
+
+	return nil
+}
+
+// Same as checkBucket, also rejects writes in readonly mod
+func (s *Store) checkWrite(bucketName []byte) error {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		return storage.ErrClosed
+	}
+
+	if s.readOnly {
+		return storage.ErrReadOnly
+	}
+
+	return s.checkBucket(bucketName)
+}
+
 func (s *Store) HasBucket(bucketName []byte) bool {
+	s.bucketMu.RLock()
+	defer s.bucketMu.RUnlock()
+
 	return storage.Contains(s.bucketList, bucketName)
 }
 
-func (s *Store) statsBucket(bucketName []byte) int {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
+func (s *Store) statsBucket(db *nutsdb.DB, bucketName []byte) int {
+	if len(bucketName) > 0 && !s.HasBucket(bucketName) {
 		return 0
 	}
 
-	treeIdx, ok := s.db.BPTreeIdx[string(bucketName)]
+	treeIdx, ok := db.BPTreeIdx[string(bucketName)]
 	if !ok {
 		return 0
 	}
@@ -265,47 +878,80 @@ func (s *Store) statsBucket(bucketName []byte) int {
 }
 
 func (s *Store) ListBucket() (buckets []string, err error) {
-	bucketList := []string{}
+	if err := s.checkBucket(nil); err != nil {
+		return nil, err
+	}
 
-	err = s.db.View(func(t *nutsdb.Tx) error {
-		return t.IterateBuckets(nutsdb.DataStructureBPTree, func(name string) {
-			bucketList = append(bucketList, string(name))
-		})
+	s.bucketMu.RLock()
+	defer s.bucketMu.RUnlock()
+
+	return append([]string{}, s.bucketList...), nil
+}
+
+func (s *Store) DeleteBucket(bucketName []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(t *nutsdb.Tx) error {
+		return s.deleteBucket(t, bucketName)
 	})
+}
 
+func (s *Store) deleteBucket(t *nutsdb.Tx, bucketName []byte) error {
+	err := t.DeleteBucket(nutsdb.DataStructureBPTree, string(bucketName))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return bucketList, nil
+	return t.DeleteBucket(nutsdb.DataStructureSet, string(bucketName))
 }
 
-func (s *Store) DeleteBucket(bucketName []byte) error {
-	if s.readOnly {
-		return errors.New("readonly mod active")
+// Nutsdb hides expired keys but keeps them in the index until deleted.
+// Runs in one write transaction, so a key set again while sweeping is not deleted
+func (s *Store) sweep() error {
+	if !s.dbMu.TryRLock() {
+		return nil
 	}
+	defer s.dbMu.RUnlock()
 
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return errors.New("unknown bucket name")
+	buckets, err := s.ListBucket()
+	if err != nil {
+		return err
 	}
 
 	return s.db.Update(func(t *nutsdb.Tx) error {
-		err := t.DeleteBucket(nutsdb.DataStructureBPTree, string(bucketName))
-		if err != nil {
-			return err
-		}
+		// Keys set without bucket too
+		for _, bucket := range append([]string{""}, buckets...) {
+			idx, ok := s.db.BPTreeIdx[bucket]
+			if !ok {
+				continue
+			}
 
-		return t.DeleteBucket(nutsdb.DataStructureSet, string(bucketName))
-	})
-}
+			records, err := idx.All()
+			if err != nil {
+				// No keys
+				continue
+			}
 
-func (s *Store) Backup(path, filename string) error {
-	// Create dir if necessary
-	_ = storage.CreateDir(strings.TrimSuffix(path, "/"))
+			for _, r := range records {
+				if r.H.Meta.Flag == nutsdb.DataDeleteFlag || !r.IsExpired() {
+					continue
+				}
 
-	return s.db.Backup(path)
-}
+				err = t.Delete(bucket, r.H.Key)
+				if err != nil {
+					return err
+				}
+			}
+		}
 
-func (s *Store) Restore(path, filename string) error {
-	return errors.New("not implemented")
+		return nil
+	})
 }
@@ -2,10 +2,20 @@ package nutsdbstorage
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
+	"github.com/xujiajun/nutsdb"
 )
 
 func TestCmd(t *testing.T) {
@@ -20,8 +30,14 @@ func TestCmd(t *testing.T) {
 	assert.Equal(t, true, bytes.Equal(key, []byte("test_2")))
 	assert.NoError(t, err)
 
-	_, err = store.MSet([]byte("posts"), []byte("test_1"), []byte("number one"))
-	assert.Error(t, err)
+	err = store.MSet([]byte("posts"), storage.KV{Key: "test_1", Value: "number one"}, storage.KV{Key: "test_2", Value: "number two"})
+	assert.NoError(t, err)
+
+	err = store.MSet([]byte("posts"), storage.KV{Key: "test_3", Value: "number three"}, storage.KV{Key: "", Value: "empty"})
+	assert.ErrorIs(t, err, storage.ErrEmptyKey)
+
+	_, err = store.Set([]byte("unknown"), []byte("test_1"), []byte("number one"))
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
 
 	res, err := store.Get([]byte("posts"), []byte("test_1"))
 	assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
@@ -43,11 +59,33 @@ func TestCmd(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, list, []string{"number two"})
 
-	_, err = store.PrevList([]byte("posts"), nil, 10)
-	assert.Error(t, err)
+	list, err = store.PrevList([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"number two", "number one"})
 
-	_, err = store.PrevList([]byte("posts"), []byte("test_1"), 10)
-	assert.Error(t, err)
+	list, err = store.PrevList([]byte("posts"), []byte("test_2"), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"number one"})
+
+	list, err = store.PrevList([]byte("posts"), []byte("test_1"), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string(nil))
+
+	list, err = store.PrevList([]byte("posts"), []byte("test_3"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"number two"})
+
+	list, err = store.PrevList([]byte("posts"), nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"number two"})
+
+	kvs, err := store.ListKV([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, kvs, []storage.KV{{Key: "test_1", Value: "number one"}, {Key: "test_2", Value: "number two"}})
+
+	kvs, err = store.PrevListKV([]byte("posts"), []byte("test_2"), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, kvs, []storage.KV{{Key: "test_1", Value: "number one"}})
 
 	ok, err := store.KeyExist([]byte("posts"), []byte("test_1"))
 	assert.True(t, ok)
@@ -62,7 +100,10 @@ func TestCmd(t *testing.T) {
 
 	res, err = store.Get([]byte("posts"), []byte("test_1"))
 	assert.Equal(t, true, bytes.Equal(res, nil))
-	assert.NoError(t, err)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	_, err = store.Get([]byte("pages"), []byte("test_1"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
 
 	err = store.DeleteBucket([]byte("posts"))
 	assert.NoError(t, err)
@@ -74,6 +115,1081 @@ func TestCmd(t *testing.T) {
 	err = store.CloseStore()
 	assert.NoError(t, err)
 
+	_, err = store.Get([]byte("posts"), []byte("test_2"))
+	assert.ErrorIs(t, err, storage.ErrClosed)
+
+	err = store.CloseStore()
+	assert.ErrorIs(t, err, storage.ErrClosed)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestBatch(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	batch := storage.NewBatch().
+		Delete([]byte("posts"), []byte("test_1")).
+		Set([]byte("pages"), []byte("test_1"), []byte("number one"))
+	assert.Equal(t, 2, batch.Len())
+
+	err = store.Write(batch)
+	assert.NoError(t, err)
+
+	ok, err := store.KeyExist([]byte("posts"), []byte("test_1"))
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	res, err := store.Get([]byte("pages"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+	assert.NoError(t, err)
+
+	batch = storage.NewBatch().
+		Set([]byte("posts"), []byte("test_2"), []byte("number two")).
+		Set([]byte("unknown"), []byte("test_2"), []byte("number two"))
+
+	err = store.Write(batch)
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	ok, err = store.KeyExist([]byte("posts"), []byte("test_2"))
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestPage(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	for _, k := range []string{"test_1", "test_2", "test_3"} {
+		_, err = store.Set([]byte("posts"), []byte(k), []byte(k))
+		assert.NoError(t, err)
+	}
+
+	page, err := store.ListPage([]byte("posts"), "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, page.Items, []storage.KV{{Key: "test_1", Value: "test_1"}, {Key: "test_2", Value: "test_2"}})
+	assert.True(t, page.HasMore)
+
+	page, err = store.ListPage([]byte("posts"), page.NextCursor, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, page.Items, []storage.KV{{Key: "test_3", Value: "test_3"}})
+	assert.False(t, page.HasMore)
+
+	page, err = store.PrevListPage([]byte("posts"), page.PrevCursor, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, page.Items, []storage.KV{{Key: "test_2", Value: "test_2"}, {Key: "test_1", Value: "test_1"}})
+	assert.False(t, page.HasMore)
+
+	_, err = store.ListPage([]byte("posts"), "#", 2)
+	assert.ErrorIs(t, err, storage.ErrInvalidCursor)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestPrevListLarge(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	// Keys over many B+tree leaves, zero and 0xff bytes included
+	keys := []string{}
+	items := []storage.KV{}
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("k%d", i)
+		if i%7 == 0 {
+			k += "\x00"
+		} else if i%11 == 0 {
+			k += "\xff\xff"
+		} else if i%13 == 0 {
+			// Sorts after the probe for the next key
+			k += strings.Repeat("\xff", 20)
+		}
+
+		keys = append(keys, k)
+		items = append(items, storage.KV{Key: k, Value: k})
+	}
+
+	err = store.MSet([]byte("posts"), items...)
+	assert.NoError(t, err)
+
+	// Deleted keys are skipped
+	live := []string{}
+	for i, k := range keys {
+		if i%10 == 0 {
+			err = store.Delete([]byte("posts"), []byte(k))
+			assert.NoError(t, err)
+			continue
+		}
+
+		live = append(live, k)
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(live)))
+
+	list := []string{}
+	var cursor []byte
+	for {
+		page, err := store.PrevListKV([]byte("posts"), cursor, 7)
+		assert.NoError(t, err)
+
+		if len(page) == 0 {
+			break
+		}
+
+		for _, item := range page {
+			list = append(list, item.Key)
+		}
+
+		cursor = []byte(page[len(page)-1].Key)
+	}
+	assert.Equal(t, list, live)
+
+	page, err := store.PrevListKV([]byte("posts"), []byte(live[1000]), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(page), live[1001:1004])
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestRange(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		_, err = store.Set([]byte("posts"), storage.U64tob(i), []byte(fmt.Sprintf("number %d", i)))
+		assert.NoError(t, err)
+	}
+
+	_, err = store.Set([]byte("pages"), storage.U64tob(3), []byte("page 3"))
+	assert.NoError(t, err)
+
+	list, err := store.Range([]byte("posts"), storage.U64tob(2), storage.U64tob(4), storage.RangeOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(list), []string{"number 2", "number 3", "number 4"})
+
+	list, err = store.Range([]byte("posts"), storage.U64tob(2), storage.U64tob(4), storage.RangeOptions{StartExclusive: true, EndExclusive: true})
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(list), []string{"number 3"})
+
+	list, err = store.Range([]byte("posts"), nil, storage.U64tob(4), storage.RangeOptions{Reverse: true, Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(list), []string{"number 4", "number 3"})
+	assert.Equal(t, list[0].Key, string(storage.U64tob(4)))
+
+	list, err = store.Range([]byte("posts"), storage.U64tob(4), nil, storage.RangeOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(list), []string{"number 4", "number 5"})
+
+	list, err = store.Range([]byte("posts"), storage.U64tob(6), storage.U64tob(9), storage.RangeOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, list, []storage.KV(nil))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestPrefixScan(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	for _, k := range []string{"user:4:post:1", "user:42:post:7", "user:42:post:8", "user:43:post:1"} {
+		_, err = store.Set([]byte("posts"), []byte(k), []byte(k))
+		assert.NoError(t, err)
+	}
+
+	list, err := store.PrefixScan([]byte("posts"), []byte("user:42:"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []storage.KV{{Key: "user:42:post:7", Value: "user:42:post:7"}, {Key: "user:42:post:8", Value: "user:42:post:8"}})
+
+	list, err = store.PrefixScan([]byte("posts"), []byte("user:4"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(list), []string{"user:42:post:7", "user:42:post:8", "user:43:post:1"})
+
+	list, err = store.PrefixScan([]byte("posts"), []byte("user:5"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []storage.KV(nil))
+
+	// Deleted keys do not count toward the limit
+	for _, k := range []string{"user:42:a", "user:42:b", "user:42:c"} {
+		_, err = store.Set([]byte("pages"), []byte(k), []byte(k))
+		assert.NoError(t, err)
+	}
+
+	err = store.Delete([]byte("pages"), []byte("user:42:a"))
+	assert.NoError(t, err)
+
+	list, err = store.PrefixScan([]byte("pages"), []byte("user:42:"), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(list), []string{"user:42:b", "user:42:c"})
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestForEach(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		_, err = store.Set([]byte("posts"), storage.U64tob(i), []byte(fmt.Sprintf("number %d", i)))
+		assert.NoError(t, err)
+	}
+
+	items := map[uint64]string{}
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		items[storage.Btou64(k)] = string(v)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, len(items), 5)
+	assert.Equal(t, items[3], "number 3")
+
+	counter := 0
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		counter++
+		if counter == 2 {
+			return storage.ErrStopIteration
+		}
+
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, counter, 2)
+
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		return storage.ErrNotFound
+	})
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	err = store.ForEach([]byte("pages"), func(k, v []byte) error {
+		return storage.ErrNotFound
+	})
+	assert.NoError(t, err)
+
+	// CloseStore does not wait for fn, it ends the iteration
+	closed := make(chan error, 1)
+	counter = 0
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		counter++
+		if counter == 1 {
+			go func() {
+				closed <- store.CloseStore()
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		return nil
+	})
+	assert.ErrorIs(t, err, storage.ErrReleased)
+	assert.NoError(t, <-closed)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestBuckets(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	err = store.CreateBucket([]byte("drafts"))
+	assert.NoError(t, err)
+
+	err = store.CreateBucket([]byte("drafts"))
+	assert.NoError(t, err)
+
+	err = store.CreateBucket(storage.MetaBucket)
+	assert.ErrorIs(t, err, storage.ErrInvalidBucket)
+
+	err = store.CreateBucket(nil)
+	assert.ErrorIs(t, err, storage.ErrInvalidBucket)
+
+	_, err = store.Set([]byte("drafts"), []byte("draft_1"), []byte("draft"))
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	store, err = NewStore([]string{"options"}, "./db/", "storage_test", false)
+	assert.NoError(t, err)
+
+	assert.Equal(t, store.HasBucket([]byte("drafts")), true)
+	assert.Equal(t, store.HasBucket([]byte("posts")), true)
+	assert.Equal(t, store.HasBucket(storage.MetaBucket), false)
+
+	res, err := store.Get([]byte("drafts"), []byte("draft_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("draft")))
+	assert.NoError(t, err)
+
+	err = store.DropBucket([]byte("drafts"))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("drafts"), []byte("draft_2"), []byte("draft"))
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	err = store.DropBucket([]byte("drafts"))
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	// Created again empty
+	err = store.CreateBucket([]byte("drafts"))
+	assert.NoError(t, err)
+
+	_, err = store.Get([]byte("drafts"), []byte("draft_1"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	err = store.DropBucket([]byte("drafts"))
+	assert.NoError(t, err)
+
+	// Writes racing the drop do not show up in the bucket created again
+	for i := 0; i < 20; i++ {
+		err = store.CreateBucket([]byte("drafts"))
+		assert.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+
+				for n := 0; ; n++ {
+					_, err := store.Set([]byte("drafts"), []byte(fmt.Sprintf("draft_%d_%d", j, n)), []byte("draft"))
+					if err != nil {
+						assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+						return
+					}
+				}
+			}(j)
+		}
+
+		time.Sleep(time.Millisecond)
+
+		err = store.DropBucket([]byte("drafts"))
+		assert.NoError(t, err)
+
+		wg.Wait()
+
+		err = store.CreateBucket([]byte("drafts"))
+		assert.NoError(t, err)
+
+		list, err := store.ListKV([]byte("drafts"), nil, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, list)
+
+		err = store.DropBucket([]byte("drafts"))
+		assert.NoError(t, err)
+	}
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	store, err = OpenStore()
+	assert.NoError(t, err)
+
+	assert.Equal(t, store.HasBucket([]byte("drafts")), false)
+
+	buckets, err := store.ListBucket()
+	assert.NoError(t, err)
+	assert.Equal(t, buckets, []string{"options", "posts", "pages"})
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestTTL(t *testing.T) {
+	store, err := NewStore([]string{"options", "posts", "pages"}, "./db/", "storage_test", false, storage.WithSweepInterval(time.Hour))
+	assert.NoError(t, err)
+
+	_, err = store.SetWithTTL([]byte("posts"), []byte("test_1"), []byte("number one"), time.Second)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	// Key without bucket
+	_, err = store.SetWithTTL(nil, []byte("test_1"), []byte("no bucket"), time.Second)
+	assert.NoError(t, err)
+
+	ttl, err := store.TTL([]byte("posts"), []byte("test_1"))
+	assert.NoError(t, err)
+	assert.Equal(t, ttl > 0 && ttl <= time.Second, true)
+
+	ttl, err = store.TTL([]byte("posts"), []byte("test_2"))
+	assert.NoError(t, err)
+	assert.Equal(t, ttl, storage.NoTTL)
+
+	_, err = store.TTL([]byte("posts"), []byte("test_3"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	res, err := store.Get([]byte("posts"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+	assert.NoError(t, err)
+
+	time.Sleep(2 * time.Second)
+
+	_, err = store.Get([]byte("posts"), []byte("test_1"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	_, err = store.TTL([]byte("posts"), []byte("test_1"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	ok, err := store.KeyExist([]byte("posts"), []byte("test_1"))
+	assert.NoError(t, err)
+	assert.Equal(t, ok, false)
+
+	items, err := store.MGet([]byte("posts"), []byte("test_1"), []byte("test_2"))
+	assert.NoError(t, err)
+	assert.Equal(t, items, map[string]interface{}{"test_2": "number two"})
+
+	list, err := store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"number two"})
+
+	list, err = store.PrevList([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"number two"})
+
+	// Nutsdb ttl is in seconds, sweep directly instead of waiting for the sweeper
+	err = store.sweep()
+	assert.NoError(t, err)
+
+	records, err := store.db.BPTreeIdx["posts"].Range([]byte("test_1"), []byte("test_1"))
+	assert.NoError(t, err)
+	assert.Equal(t, records[0].H.Meta.Flag, nutsdb.DataDeleteFlag)
+
+	records, err = store.db.BPTreeIdx[""].Range([]byte("test_1"), []byte("test_1"))
+	assert.NoError(t, err)
+	assert.Equal(t, records[0].H.Meta.Flag, nutsdb.DataDeleteFlag)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestIncr(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				_, err := store.Incr([]byte("posts"), []byte("views"), 2)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	n, err := store.Decr([]byte("posts"), []byte("views"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, n, int64(999))
+
+	res, err := store.Get([]byte("posts"), []byte("views"))
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Btou64(res), uint64(999))
+
+	n, err = store.Decr([]byte("posts"), []byte("likes"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, n, int64(-3))
+
+	n, err = store.Incr([]byte("posts"), []byte("likes"), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, n, int64(2))
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	_, err = store.Incr([]byte("posts"), []byte("test_1"), 1)
+	assert.ErrorIs(t, err, storage.ErrInvalidCounter)
+
+	_, err = store.Incr([]byte("unknown"), []byte("views"), 1)
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestConditional(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	err = store.SetIfAbsent([]byte("posts"), []byte("doc"), []byte("v1"))
+	assert.NoError(t, err)
+
+	err = store.SetIfAbsent([]byte("posts"), []byte("doc"), []byte("v2"))
+	assert.ErrorIs(t, err, storage.ErrConflict)
+
+	var conflict *storage.ConflictError
+	err = store.CompareAndSwap([]byte("posts"), []byte("doc"), []byte("v0"), []byte("v2"))
+	assert.Equal(t, errors.As(err, &conflict), true)
+	assert.Equal(t, conflict.Current, []byte("v1"))
+
+	err = store.CompareAndSwap([]byte("posts"), []byte("doc"), []byte("v1"), []byte("v2"))
+	assert.NoError(t, err)
+
+	res, err := store.Get([]byte("posts"), []byte("doc"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("v2")))
+	assert.NoError(t, err)
+
+	err = store.CompareAndSwap([]byte("posts"), []byte("missing"), []byte("v1"), []byte("v2"))
+	assert.Equal(t, errors.As(err, &conflict), true)
+	assert.Nil(t, conflict.Current)
+
+	err = store.DeleteIfEquals([]byte("posts"), []byte("doc"), []byte("v1"))
+	assert.ErrorIs(t, err, storage.ErrConflict)
+
+	err = store.DeleteIfEquals([]byte("posts"), []byte("doc"), []byte("v2"))
+	assert.NoError(t, err)
+
+	_, err = store.Get([]byte("posts"), []byte("doc"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Concurrent read-modify-write loops do not lose updates
+	err = store.SetIfAbsent([]byte("posts"), []byte("count"), []byte("0"))
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				res, err := store.Get([]byte("posts"), []byte("count"))
+				assert.NoError(t, err)
+
+				n, _ := strconv.Atoi(string(res))
+				err = store.CompareAndSwap([]byte("posts"), []byte("count"), res, []byte(strconv.Itoa(n+1)))
+				if !errors.Is(err, storage.ErrConflict) {
+					assert.NoError(t, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	res, err = store.Get([]byte("posts"), []byte("count"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("10")))
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestSequence(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	for i, v := range []string{"first", "second", "third"} {
+		seq, err := store.Append([]byte("posts"), []byte(v))
+		assert.NoError(t, err)
+		assert.Equal(t, seq, uint64(i+1))
+	}
+
+	list, err := store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"first", "second", "third"})
+
+	seq, err := store.NextSequence([]byte("posts"))
+	assert.NoError(t, err)
+	assert.Equal(t, seq, uint64(4))
+
+	seq, err = store.NextSequence([]byte("pages"))
+	assert.NoError(t, err)
+	assert.Equal(t, seq, uint64(1))
+
+	_, err = store.NextSequence([]byte("unknown"))
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	store, err = OpenStore()
+	assert.NoError(t, err)
+
+	seq, err = store.NextSequence([]byte("posts"))
+	assert.NoError(t, err)
+	assert.Equal(t, seq, uint64(5))
+
+	err = store.CreateBucket([]byte("logs"))
+	assert.NoError(t, err)
+
+	_, err = store.Append([]byte("logs"), []byte("log"))
+	assert.NoError(t, err)
+
+	err = store.DropBucket([]byte("logs"))
+	assert.NoError(t, err)
+
+	err = store.CreateBucket([]byte("logs"))
+	assert.NoError(t, err)
+
+	seq, err = store.NextSequence([]byte("logs"))
+	assert.NoError(t, err)
+	assert.Equal(t, seq, uint64(1))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestInsert(t *testing.T) {
+	_, err := NewStore([]string{"options", "posts", "pages"}, "./db/", "storage_test", false, storage.WithNodeID(2048))
+	assert.Error(t, err)
+
+	store, err := NewStore([]string{"options", "posts", "pages"}, "./db/", "storage_test", false, storage.WithNodeID(7))
+	assert.NoError(t, err)
+
+	ids := []int64{}
+	for _, v := range []string{"first", "second", "third"} {
+		id, err := store.Insert([]byte("posts"), []byte(v))
+		assert.NoError(t, err)
+
+		ids = append(ids, id)
+	}
+
+	assert.Equal(t, ids[0] < ids[1] && ids[1] < ids[2], true)
+
+	res, err := store.Get([]byte("posts"), storage.U64tob(int(ids[1])))
+	assert.Equal(t, true, bytes.Equal(res, []byte("second")))
+	assert.NoError(t, err)
+
+	list, err := store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"first", "second", "third"})
+
+	_, err = store.Insert([]byte("unknown"), []byte("value"))
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestSnapshot(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	err = store.MSet([]byte("posts"), storage.KV{Key: "test_1", Value: "one"}, storage.KV{Key: "test_2", Value: "two"})
+	assert.NoError(t, err)
+
+	snap, err := store.Snapshot()
+	assert.NoError(t, err)
+
+	// Writers wait for the read transaction of the snapshot
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		_, err := store.Set([]byte("posts"), []byte("test_1"), []byte("changed"))
+		assert.NoError(t, err)
+
+		err = store.Delete([]byte("posts"), []byte("test_2"))
+		assert.NoError(t, err)
+	}()
+
+	res, err := snap.Get([]byte("posts"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("one")))
+	assert.NoError(t, err)
+
+	items, err := snap.MGet([]byte("posts"), []byte("test_1"), []byte("test_2"))
+	assert.NoError(t, err)
+	assert.Equal(t, items, map[string]interface{}{"test_1": "one", "test_2": "two"})
+
+	list, err := snap.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"one", "two"})
+
+	count := 0
+	err = snap.ForEach([]byte("posts"), func(k, v []byte) error {
+		count++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, count, 2)
+
+	snap.Release()
+	snap.Release()
+
+	_, err = snap.Get([]byte("posts"), []byte("test_1"))
+	assert.ErrorIs(t, err, storage.ErrReleased)
+
+	<-done
+
+	res, err = store.Get([]byte("posts"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("changed")))
+	assert.NoError(t, err)
+
+	// CloseStore releases the snapshot blocking a writer before waiting for it
+	snap, err = store.Snapshot()
+	assert.NoError(t, err)
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := store.Set([]byte("posts"), []byte("test_3"), []byte("three"))
+		written <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- store.CloseStore()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = snap.Get([]byte("posts"), []byte("test_1"))
+	assert.ErrorIs(t, err, storage.ErrReleased)
+
+	assert.NoError(t, <-written)
+	assert.NoError(t, <-closed)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestTx(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("one"))
+	assert.NoError(t, err)
+
+	// Move a key between buckets as one unit
+	err = store.Update(func(tx interfaces.Tx) error {
+		v, err := tx.Get([]byte("posts"), []byte("test_1"))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Set([]byte("pages"), []byte("test_1"), v)
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete([]byte("posts"), []byte("test_1"))
+	})
+	assert.NoError(t, err)
+
+	res, err := store.Get([]byte("pages"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("one")))
+	assert.NoError(t, err)
+
+	_, err = store.Get([]byte("posts"), []byte("test_1"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Failed closure writes nothing
+	errAbort := errors.New("abort")
+	err = store.Update(func(tx interfaces.Tx) error {
+		err := tx.Set([]byte("posts"), []byte("test_2"), []byte("two"))
+		assert.NoError(t, err)
+
+		return errAbort
+	})
+	assert.ErrorIs(t, err, errAbort)
+
+	_, err = store.Get([]byte("posts"), []byte("test_2"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	err = store.Update(func(tx interfaces.Tx) error {
+		return tx.Set([]byte("unknown"), []byte("test_2"), []byte("two"))
+	})
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	err = store.View(func(tx interfaces.Tx) error {
+		res, err := tx.Get([]byte("pages"), []byte("test_1"))
+		assert.Equal(t, true, bytes.Equal(res, []byte("one")))
+		assert.NoError(t, err)
+
+		list, err := tx.List([]byte("pages"), nil, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, list, []string{"one"})
+
+		return tx.Set([]byte("pages"), []byte("test_2"), []byte("two"))
+	})
+	assert.ErrorIs(t, err, storage.ErrReadOnly)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestBackup(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	err = store.CreateBucket([]byte("comments"))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	_, err = store.SetWithTTL([]byte("comments"), []byte("test_1"), []byte("comment one"), time.Hour)
+	assert.NoError(t, err)
+
+	err = store.Backup("./db/backup", "nutsdb_1.tar.gz")
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	// Several backups in one folder
+	err = store.Backup("./db/backup", "nutsdb_2.tar.gz")
+	assert.NoError(t, err)
+
+	// Changes after backup are lost on restore
+	err = store.Delete([]byte("posts"), []byte("test_1"))
+	assert.NoError(t, err)
+
+	err = store.DropBucket([]byte("comments"))
+	assert.NoError(t, err)
+
+	// Unreleased snapshot does not block the restore
+	snap, err := store.Snapshot()
+	assert.NoError(t, err)
+
+	// Reads keep working while restoring
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// Gone once the backup is restored
+		for i := 0; i < 100; i++ {
+			_, err := store.Get([]byte("posts"), []byte("test_2"))
+			if err != nil {
+				assert.ErrorIs(t, err, storage.ErrNotFound)
+			}
+		}
+	}()
+
+	// Writer blocked by the snapshot does not block the restore
+	written := make(chan error, 1)
+	go func() {
+		_, err := store.Set([]byte("posts"), []byte("test_4"), []byte("number four"))
+		written <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	err = store.Restore("./db/backup", "nutsdb_1.tar.gz")
+	assert.NoError(t, err)
+
+	<-done
+	assert.NoError(t, <-written)
+
+	_, err = snap.Get([]byte("posts"), []byte("test_2"))
+	assert.ErrorIs(t, err, storage.ErrReleased)
+	snap.Release()
+
+	res, err := store.Get([]byte("posts"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+	assert.NoError(t, err)
+
+	_, err = store.Get([]byte("posts"), []byte("test_2"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	assert.Equal(t, store.HasBucket([]byte("comments")), true)
+
+	res, err = store.Get([]byte("comments"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("comment one")))
+	assert.NoError(t, err)
+
+	ttl, err := store.TTL([]byte("comments"), []byte("test_1"))
+	assert.NoError(t, err)
+	assert.Equal(t, ttl > 0 && ttl <= time.Hour, true)
+
+	err = store.Restore("./db/backup", "nutsdb_2.tar.gz")
+	assert.NoError(t, err)
+
+	res, err = store.Get([]byte("posts"), []byte("test_2"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("number two")))
+	assert.NoError(t, err)
+
+	// Store still writable after restore
+	_, err = store.Set([]byte("posts"), []byte("test_3"), []byte("number three"))
+	assert.NoError(t, err)
+
+	err = os.WriteFile("./db/backup/invalid.tar.gz", []byte("invalid"), 0644)
+	assert.NoError(t, err)
+
+	err = store.Restore("./db/backup", "invalid.tar.gz")
+	assert.ErrorIs(t, err, storage.ErrInvalidArchive)
+
+	res, err = store.Get([]byte("posts"), []byte("test_3"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("number three")))
+	assert.NoError(t, err)
+
+	// ForEach callbacks may read the store while a Restore waits for the
+	// swap, the swap ends the iteration unless it was done before
+	restored := make(chan error, 1)
+	started := false
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		if !started {
+			started = true
+
+			go func() {
+				restored <- store.Restore("./db/backup", "nutsdb_1.tar.gz")
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		_, err := store.KeyExist([]byte("posts"), k)
+		return err
+	})
+	if err != nil {
+		assert.ErrorIs(t, err, storage.ErrReleased)
+	}
+	assert.NoError(t, <-restored)
+
+	_, err = store.Get([]byte("posts"), []byte("test_3"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+
+	err = os.RemoveAll("./db/backup")
+	assert.NoError(t, err)
+}
+
+func TestDump(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	err = store.CreateBucket([]byte("comments"))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), storage.U64tob(2), []byte{0, 1, 255})
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("comments"), []byte("test_1"), []byte("comment one"))
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	err = storage.Dump(&buf, store)
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+
+	// Missing buckets created on load
+	store, err = NewStore([]string{"options"}, "./db/", "storage_test", false)
+	assert.NoError(t, err)
+
+	err = storage.Load(&buf, store)
+	assert.NoError(t, err)
+
+	assert.Equal(t, store.HasBucket([]byte("posts")), true)
+	assert.Equal(t, store.HasBucket([]byte("comments")), true)
+
+	res, err := store.Get([]byte("posts"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+	assert.NoError(t, err)
+
+	res, err = store.Get([]byte("posts"), storage.U64tob(2))
+	assert.Equal(t, true, bytes.Equal(res, []byte{0, 1, 255}))
+	assert.NoError(t, err)
+
+	res, err = store.Get([]byte("comments"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("comment one")))
+	assert.NoError(t, err)
+
+	err = storage.Load(strings.NewReader(`{"bucket":"posts","key":"!","value":"dmFsdWU="}`), store)
+	assert.Error(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+// Reads run in nutsdb transactions, run with -race
+func TestConcurrentRead(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			_, err := store.Set([]byte("posts"), []byte(fmt.Sprintf("test_%d", i)), []byte("number"))
+			assert.NoError(t, err)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		_, err = store.PrevListKV([]byte("posts"), nil, 10)
+		assert.NoError(t, err)
+
+		_, err = store.Range([]byte("posts"), nil, nil, storage.RangeOptions{Limit: 10})
+		assert.NoError(t, err)
+
+		_, err = store.PrefixScan([]byte("posts"), []byte("test_"), 10)
+		assert.NoError(t, err)
+	}
+
+	wg.Wait()
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
 	err = DeleteStore()
 	assert.NoError(t, err)
 }
@@ -0,0 +1,102 @@
+package nutsdbstorage
+
+import (
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
+	"github.com/xujiajun/nutsdb"
+)
+
+// Store view inside Update and View (nutsdb transactions). Nutsdb applies
+// writes on commit, so reads do not see the writes of the same transaction
+type Tx struct {
+	s        *Store
+	t        *nutsdb.Tx
+	writable bool
+}
+
+var _ interfaces.Tx = (*Tx)(nil)
+
+// Run fn in a nutsdb write transaction, committed when fn returns nil and
+// rolled back otherwise. fn must only use tx, store calls wait for the db lock
+func (s *Store) Update(fn func(tx interfaces.Tx) error) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(t *nutsdb.Tx) error {
+		return fn(&Tx{s: s, t: t, writable: true})
+	})
+}
+
+// Run fn in a nutsdb read transaction, writes return storage.ErrReadOnly.
+// fn must only use tx, a Restore waiting meanwhile blocks store calls
+func (s *Store) View(fn func(tx interfaces.Tx) error) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(nil); err != nil {
+		return err
+	}
+
+	return s.db.View(func(t *nutsdb.Tx) error {
+		return fn(&Tx{s: s, t: t})
+	})
+}
+
+func (tx *Tx) Get(bucketName []byte, k []byte) ([]byte, error) {
+	if err := tx.s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	return get(tx.t, bucketName, k)
+}
+
+func (tx *Tx) Set(bucketName []byte, k []byte, v []byte) error {
+	if err := tx.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	if len(v) == 0 {
+		return storage.ErrEmptyValue
+	}
+
+	return tx.t.Put(string(bucketName), k, v, nutsdb.Persistent)
+}
+
+func (tx *Tx) Delete(bucketName []byte, k []byte) error {
+	if err := tx.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	return tx.t.Delete(string(bucketName), k)
+}
+
+// order by asc
+func (tx *Tx) List(bucketName []byte, k []byte, perpage int) ([]string, error) {
+	if err := tx.s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	items, err := tx.s.listKV(tx.s.db, tx.t, bucketName, k, perpage)
+
+	return storage.Values(items), err
+}
+
+func (tx *Tx) checkWrite(bucketName []byte) error {
+	if !tx.writable {
+		return storage.ErrReadOnly
+	}
+
+	return tx.s.checkWrite(bucketName)
+}
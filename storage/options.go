@@ -0,0 +1,41 @@
+package storage
+
+import "time"
+
+// Default period of the expired key sweeper
+const DefaultSweepInterval = time.Minute
+
+// Optional store settings, given to NewStore of every backend
+type Options struct {
+	SweepInterval time.Duration // 0 or less disables the expired key sweeper
+	NodeID        int64         // snowflake node of Insert ids, 0-1023
+}
+
+type Option func(*Options)
+
+// Options with defaults, opts applied in order
+func NewOptions(opts ...Option) Options {
+	o := Options{
+		SweepInterval: DefaultSweepInterval,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// Period of the background goroutine deleting expired keys
+func WithSweepInterval(d time.Duration) Option {
+	return func(o *Options) {
+		o.SweepInterval = d
+	}
+}
+
+// Snowflake node id, must be unique per writer process sharing a keyspace
+func WithNodeID(id int64) Option {
+	return func(o *Options) {
+		o.NodeID = id
+	}
+}
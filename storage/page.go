@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"encoding/base64"
+)
+
+// One page of a cursor based list.
+//
+// NextCursor continues in the same direction (pass it back to the same
+// method), PrevCursor goes the other way. Both are opaque tokens
+type Page struct {
+	Items      []KV   `json:"items"`
+	NextCursor string `json:"next_cursor"`
+	PrevCursor string `json:"prev_cursor"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// Build a page from items listed with perpage+1 limit. The extra item only
+// tells that there is more to list, it is not returned
+func NewPage(items []KV, perpage int) *Page {
+	p := &Page{}
+
+	if len(items) > perpage {
+		p.HasMore = true
+		items = items[:perpage]
+	}
+
+	if len(items) > 0 {
+		p.Items = items
+		p.PrevCursor = EncodeCursor([]byte(items[0].Key))
+		p.NextCursor = EncodeCursor([]byte(items[len(items)-1].Key))
+	}
+
+	return p
+}
+
+// One page of a listing after cursor, read by list (ListKV or PrevListKV
+// of a bucket). Stores implement ListPage and PrevListPage with it
+func ListPage(list func(cursor []byte, n int) ([]KV, error), cursor string, perpage int) (*Page, error) {
+	k, err := DecodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if perpage < 1 {
+		perpage = 1
+	}
+
+	// Peek one more item for HasMore
+	items, err := list(k, perpage+1)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPage(items, perpage), nil
+}
+
+// Cursor token of a real key, empty key gives empty cursor
+func EncodeCursor(k []byte) string {
+	if len(k) == 0 {
+		return ""
+	}
+
+	return base64.RawURLEncoding.EncodeToString(k)
+}
+
+// Real key of a cursor token, empty cursor gives nil key (first page)
+func DecodeCursor(cursor string) ([]byte, error) {
+	if len(cursor) == 0 {
+		return nil, nil
+	}
+
+	k, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return k, nil
+}
+
+// Items per list call of Walk
+const walkChunk = 100
+
+// Call fn for every item of a listing, read in chunks by list (up to n items
+// after cursor like ListKV, nil cursor for the first chunk). No store lock is
+// held while fn runs, so fn may call the store. fn may return
+// ErrStopIteration to stop early
+func Walk(list func(cursor []byte, n int) ([]KV, error), fn func(k, v []byte) error) error {
+	var cursor []byte
+
+	for {
+		items, err := list(cursor, walkChunk)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			err := fn([]byte(item.Key), []byte(item.Value))
+			if err == ErrStopIteration {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+
+		if len(items) < walkChunk {
+			return nil
+		}
+
+		cursor = []byte(items[len(items)-1].Key)
+	}
+}
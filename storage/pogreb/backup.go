@@ -0,0 +1,117 @@
+package pogrebstorage
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/akrylysov/pogreb"
+	"github.com/uretgec/mylsmdb/storage"
+)
+
+// Write all db entries (buckets, metadata and ttl envelopes) as a storage
+// archive to path/filename. Pogreb has no snapshots: entries are read from
+// db.Items() while writes continue, so each entry is saved as it was when read
+func (s *Store) Backup(path, filename string) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(nil); err != nil {
+		return err
+	}
+
+	return storage.CreateArchive(path, filename, func(a *storage.ArchiveWriter) error {
+		c := s.db.Items()
+		for {
+			key, value, err := c.Next()
+			if err == pogreb.ErrIterationDone {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			err = a.Write(key, value)
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// Replace the db with a Backup archive. The archive is loaded into a new
+// pogreb folder next to the db while the store keeps serving calls. Then
+// running calls are waited for, the new folder replaces the db folder and is
+// reopened with a rebuilt key index; calls made meanwhile wait for it.
+// Buckets created after NewStore come from the archive catalog. The store is
+// closed when no db can be opened again
+func (s *Store) Restore(path, filename string) error {
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(s.dir), filepath.Base(s.dir)+".restore")
+	if err != nil {
+		return err
+	}
+
+	err = restoreArchive(dir, path, filename)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	s.sweeper.Stop()
+	s.sweeper = nil
+
+	// Index file not saved, the restored db gets a new one
+	err = s.db.Close()
+	if err == nil {
+		err = storage.SwapDir(s.dir, dir)
+	}
+
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+
+	// Reopen the restored db, or the old one when the swap failed
+	if oerr := s.open(); oerr != nil {
+		atomic.StoreInt32(&s.closed, 1)
+
+		if err == nil {
+			err = oerr
+		}
+	}
+
+	return err
+}
+
+// Load archive entries into a new pogreb folder
+func restoreArchive(dir, path, filename string) error {
+	// Synced once before close, not on every put
+	db, err := pogreb.Open(dir, nil)
+	if err != nil {
+		return err
+	}
+
+	err = storage.ReadArchive(path, filename, func(key, value []byte) error {
+		return db.Put(key, value)
+	})
+
+	if err == nil {
+		err = db.Sync()
+	}
+
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
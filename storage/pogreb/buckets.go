@@ -0,0 +1,125 @@
+package pogrebstorage
+
+import (
+	"bytes"
+
+	"github.com/akrylysov/pogreb"
+	"github.com/uretgec/mylsmdb/storage"
+)
+
+// Merge the bucket catalog saved in the metadata bucket with the bucket list
+// given to NewStore, and save the new ones
+func (s *Store) loadBuckets() error {
+	for _, b := range s.bucketList {
+		if err := storage.ValidBucketName([]byte(b)); err != nil {
+			return err
+		}
+	}
+
+	prefix := storage.BucketKey(nil)
+
+	c := s.db.Items()
+	for {
+		key, _, err := c.Next()
+		if err == pogreb.ErrIterationDone {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+
+		bucketName := key[len(prefix):]
+		if !storage.Contains(s.bucketList, bucketName) {
+			s.bucketList = append(s.bucketList, string(bucketName))
+		}
+	}
+
+	if s.readOnly {
+		return nil
+	}
+
+	for _, b := range s.bucketList {
+		err := s.db.Put(storage.BucketKey([]byte(b)), []byte("1"))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add a bucket at runtime, saved in the bucket catalog.
+// Creating an existing bucket is not an error
+func (s *Store) CreateBucket(bucketName []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	if err := storage.ValidBucketName(bucketName); err != nil {
+		return err
+	}
+
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+
+	if storage.Contains(s.bucketList, bucketName) {
+		return nil
+	}
+
+	err := s.db.Put(storage.BucketKey(bucketName), []byte("1"))
+	if err != nil {
+		return err
+	}
+
+	s.bucketList = append(s.bucketList, string(bucketName))
+	return nil
+}
+
+// Delete a bucket with all keys and its sequence, and remove it from the bucket
+// catalog. Holds the write lock and the bucket list lock until done, so no
+// write reaches the bucket while its keys are deleted
+func (s *Store) DropBucket(bucketName []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	if err := storage.ValidBucketName(bucketName); err != nil {
+		return err
+	}
+
+	// Same lock order as Update: s.mu, then bucketMu
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bucketMu.Lock()
+	defer s.bucketMu.Unlock()
+
+	if !storage.Contains(s.bucketList, bucketName) {
+		return storage.ErrUnknownBucket
+	}
+
+	err := s.deleteBucket(bucketName)
+	if err == nil {
+		err = s.db.Delete(storage.SequenceKey(bucketName))
+	}
+
+	if err == nil {
+		err = s.db.Delete(storage.BucketKey(bucketName))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.bucketList = storage.Remove(s.bucketList, bucketName)
+	return nil
+}
@@ -0,0 +1,119 @@
+package pogrebstorage
+
+import (
+	"bytes"
+
+	"github.com/uretgec/mylsmdb/storage"
+)
+
+// Conditional writes read and write a key under its key lock, so they are
+// atomic against other writes of the key. A *storage.ConflictError is
+// returned when the stored value does not match
+
+// Replace the value of a key only if it is oldValue, key ttl kept
+func (s *Store) CompareAndSwap(bucketName []byte, k []byte, oldValue []byte, newValue []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	if len(newValue) == 0 {
+		return storage.ErrEmptyValue
+	}
+
+	gkey := s.gkey(bucketName, k)
+
+	m := s.locks.For(gkey)
+	m.Lock()
+	defer m.Unlock()
+
+	v, expireAt, err := s.getEnvelope(gkey)
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+
+	if err != nil || !bytes.Equal(v, oldValue) {
+		return &storage.ConflictError{BucketName: bucketName, Key: k, Current: v}
+	}
+
+	return s.put(bucketName, k, storage.Wrap(newValue, expireAt))
+}
+
+// Set the value of a key only if it is missing (or expired)
+func (s *Store) SetIfAbsent(bucketName []byte, k []byte, v []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	if len(v) == 0 {
+		return storage.ErrEmptyValue
+	}
+
+	gkey := s.gkey(bucketName, k)
+
+	m := s.locks.For(gkey)
+	m.Lock()
+	defer m.Unlock()
+
+	current, err := s.get(gkey)
+	if err == nil {
+		return &storage.ConflictError{BucketName: bucketName, Key: k, Current: current}
+	} else if err != storage.ErrNotFound {
+		return err
+	}
+
+	return s.put(bucketName, k, storage.Wrap(v, 0))
+}
+
+// Delete a key only if its value is v
+func (s *Store) DeleteIfEquals(bucketName []byte, k []byte, v []byte) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	gkey := s.gkey(bucketName, k)
+
+	m := s.locks.For(gkey)
+	m.Lock()
+	defer m.Unlock()
+
+	current, err := s.get(gkey)
+	if err != nil && err != storage.ErrNotFound {
+		return err
+	}
+
+	if err != nil || !bytes.Equal(current, v) {
+		return &storage.ConflictError{BucketName: bucketName, Key: k, Current: current}
+	}
+
+	return s.del(bucketName, k)
+}
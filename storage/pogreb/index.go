@@ -0,0 +1,276 @@
+package pogrebstorage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/akrylysov/pogreb"
+	"github.com/uretgec/mylsmdb/storage"
+)
+
+// Index file name inside the pogreb folder
+const indexFile = "keys.idx"
+
+// Pogreb iterates keys in hash order. keyIndex keeps sorted keys per bucket,
+// so List and PrevList can return keys in lexical order like leveldb.
+//
+// The index is written to disk on CloseStore and removed after it is loaded,
+// so an unclean shutdown always ends up with a rebuild from db.Items().
+// Incr and conditional writes of different keys run at once, so every key
+// lookup and change takes mu
+type keyIndex struct {
+	path    string
+	mu      sync.RWMutex
+	buckets map[string][]string
+}
+
+func newKeyIndex(path string) *keyIndex {
+	return &keyIndex{
+		path:    path,
+		buckets: make(map[string][]string),
+	}
+}
+
+// Load index file. Returns false if there is no index file
+func (idx *keyIndex) load() (bool, error) {
+	f, err := os.Open(idx.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(f).Decode(&idx.buckets)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Write index file
+func (idx *keyIndex) save() error {
+	f, err := os.Create(idx.path)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(f).Encode(idx.buckets)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Remove index file, index must be saved again to be reused
+func (idx *keyIndex) invalidate() error {
+	err := os.Remove(idx.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Rebuild index from all pogreb keys, metadata keys skipped
+func (idx *keyIndex) rebuild(db *pogreb.DB) error {
+	idx.buckets = make(map[string][]string)
+
+	c := db.Items()
+	for {
+		key, _, err := c.Next()
+		if err == pogreb.ErrIterationDone {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		bucketName, k, ok := storage.ParseKey(key)
+		if !ok || bytes.Equal(bucketName, storage.MetaBucket) {
+			continue
+		}
+
+		idx.buckets[string(bucketName)] = append(idx.buckets[string(bucketName)], string(k))
+	}
+
+	for _, keys := range idx.buckets {
+		sort.Strings(keys)
+	}
+
+	return nil
+}
+
+func (idx *keyIndex) add(bucketName, k string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	keys := idx.buckets[bucketName]
+
+	i := sort.SearchStrings(keys, k)
+	if i < len(keys) && keys[i] == k {
+		return
+	}
+
+	keys = append(keys, "")
+	copy(keys[i+1:], keys[i:])
+	keys[i] = k
+
+	idx.buckets[bucketName] = keys
+}
+
+func (idx *keyIndex) remove(bucketName, k string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	keys := idx.buckets[bucketName]
+
+	i := sort.SearchStrings(keys, k)
+	if i == len(keys) || keys[i] != k {
+		return
+	}
+
+	idx.buckets[bucketName] = append(keys[:i], keys[i+1:]...)
+}
+
+// Remove many keys of a bucket in one pass
+func (idx *keyIndex) removeAll(bucketName string, removed map[string]bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	keys := idx.buckets[bucketName][:0]
+	for _, k := range idx.buckets[bucketName] {
+		if !removed[k] {
+			keys = append(keys, k)
+		}
+	}
+
+	idx.buckets[bucketName] = keys
+}
+
+// Copy of the keys of a bucket
+func (idx *keyIndex) keys(bucketName string) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	return append([]string{}, idx.buckets[bucketName]...)
+}
+
+func (idx *keyIndex) drop(bucketName string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	delete(idx.buckets, bucketName)
+}
+
+// Keys after cursor (exclusive) order by asc, at least one like leveldb.
+// Keys rejected by keep (nil keeps all) are skipped and not counted in limit
+func (idx *keyIndex) next(bucketName, cursor string, limit int, keep func(k string) bool) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	keys := idx.buckets[bucketName]
+
+	if limit < 1 {
+		limit = 1
+	}
+
+	i := 0
+	if len(cursor) > 0 {
+		i = sort.Search(len(keys), func(n int) bool { return keys[n] > cursor })
+	}
+
+	items := []string{}
+	for ; i < len(keys) && len(items) < limit; i++ {
+		if keep == nil || keep(keys[i]) {
+			items = append(items, keys[i])
+		}
+	}
+
+	return items
+}
+
+// Keys before cursor (exclusive) order by desc, keep same as next
+func (idx *keyIndex) prev(bucketName, cursor string, limit int, keep func(k string) bool) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	keys := idx.buckets[bucketName]
+
+	if limit < 1 {
+		limit = 1
+	}
+
+	i := len(keys) - 1
+	if len(cursor) > 0 {
+		i = sort.SearchStrings(keys, cursor) - 1
+	}
+
+	items := []string{}
+	for ; i >= 0 && len(items) < limit; i-- {
+		if keep == nil || keep(keys[i]) {
+			items = append(items, keys[i])
+		}
+	}
+
+	return items
+}
+
+// Keys between start and end, bounds and order by opts, keep same as next
+func (idx *keyIndex) scan(bucketName string, start, end []byte, opts storage.RangeOptions, keep func(k string) bool) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	keys := idx.buckets[bucketName]
+
+	lo := sort.SearchStrings(keys, string(start))
+	hi := len(keys)
+	if len(end) > 0 {
+		hi = sort.Search(len(keys), func(n int) bool { return keys[n] > string(end) })
+	}
+
+	items := []string{}
+	for i := lo; i < hi && !opts.Full(len(items)); i++ {
+		k := keys[i]
+		if opts.Reverse {
+			k = keys[hi-1-(i-lo)]
+		}
+
+		if !opts.InRange([]byte(k), start, end) || (keep != nil && !keep(k)) {
+			continue
+		}
+
+		items = append(items, k)
+	}
+
+	return items
+}
+
+// Keys starting with prefix order by asc, limit 0 means no limit, keep same as next
+func (idx *keyIndex) prefix(bucketName, prefix string, limit int, keep func(k string) bool) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	keys := idx.buckets[bucketName]
+
+	items := []string{}
+	for i := sort.SearchStrings(keys, prefix); i < len(keys) && strings.HasPrefix(keys[i], prefix); i++ {
+		if limit > 0 && len(items) >= limit {
+			break
+		}
+
+		if keep == nil || keep(keys[i]) {
+			items = append(items, keys[i])
+		}
+	}
+
+	return items
+}
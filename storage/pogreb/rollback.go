@@ -0,0 +1,70 @@
+package pogrebstorage
+
+import (
+	"fmt"
+
+	"github.com/uretgec/mylsmdb/storage"
+)
+
+// Returned by a failed batch after rollback. errors.Is(err, ErrBatchNotAtomic)
+// is true for it, and errors.Is/As also reach the error that failed the batch
+type BatchError struct {
+	Err error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrBatchNotAtomic, e.Err)
+}
+
+func (e *BatchError) Is(target error) bool {
+	return target == ErrBatchNotAtomic
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Previous state (value envelope) of a key, used to undo a partially applied write
+type undoItem struct {
+	bucketName []byte
+	key        []byte
+	value      []byte
+	exists     bool
+}
+
+func (s *Store) undoItem(bucketName []byte, k []byte) (undoItem, error) {
+	u := undoItem{bucketName: bucketName, key: k}
+
+	v, err := s.getRaw(s.gkey(bucketName, k))
+	if err == nil {
+		u.value = v
+		u.exists = true
+	} else if err != storage.ErrNotFound {
+		return u, err
+	}
+
+	return u, nil
+}
+
+// Restore previous states in reverse order and return the original error
+func (s *Store) rollback(undo []undoItem, cause error) error {
+	var rerr error
+	for i := len(undo) - 1; i >= 0; i-- {
+		var err error
+		if undo[i].exists {
+			err = s.put(undo[i].bucketName, undo[i].key, undo[i].value)
+		} else {
+			err = s.del(undo[i].bucketName, undo[i].key)
+		}
+
+		if err != nil && rerr == nil {
+			rerr = err
+		}
+	}
+
+	if rerr != nil {
+		return fmt.Errorf("%w (rollback failed: %s)", cause, rerr)
+	}
+
+	return cause
+}
@@ -0,0 +1,68 @@
+package pogrebstorage
+
+import (
+	"github.com/uretgec/mylsmdb/storage"
+)
+
+// Next value (starting from 1) of the bucket sequence, saved in the metadata
+// bucket. Values are never reused, DropBucket resets the sequence
+func (s *Store) NextSequence(bucketName []byte) (uint64, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return 0, err
+	}
+
+	key := storage.SequenceKey(bucketName)
+
+	// Pogreb returns nil value for missing keys
+	v, err := s.db.Get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := storage.Incr(v, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(n), s.db.Put(key, storage.U64tob(int(n)))
+}
+
+// Save v under the next bucket sequence (storage.U64tob), so List returns
+// appended values in insertion order. Returns the sequence
+func (s *Store) Append(bucketName []byte, v []byte) (uint64, error) {
+	if len(v) == 0 {
+		return 0, storage.ErrEmptyValue
+	}
+
+	seq, err := s.NextSequence(bucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = s.Set(bucketName, storage.U64tob(int(seq)), v)
+
+	return seq, err
+}
+
+// Save v under a new snowflake id (storage.U64tob). Ids are time ordered and
+// unique across processes opened with different storage.WithNodeID. Returns the id
+func (s *Store) Insert(bucketName []byte, v []byte) (int64, error) {
+	if len(v) == 0 {
+		return 0, storage.ErrEmptyValue
+	}
+
+	id := s.node.Generate().Int64()
+
+	_, err := s.Set(bucketName, storage.U64tob(int(id)), v)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
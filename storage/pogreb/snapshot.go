@@ -0,0 +1,74 @@
+package pogrebstorage
+
+import (
+	"sync/atomic"
+
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
+)
+
+// Best-effort read-only view. Pogreb has no snapshots, so reads go to the
+// live store and writes after Store.Snapshot are visible. Each MGet call
+// alone is consistent (taken under the store and key locks), List too but
+// for Incr and conditional writes meanwhile, ForEach is not
+type Snapshot struct {
+	s        *Store
+	released int32
+}
+
+var _ interfaces.Snapshot = (*Snapshot)(nil)
+
+func (s *Store) Snapshot() (interfaces.Snapshot, error) {
+	if err := s.checkBucket(nil); err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{s: s}, nil
+}
+
+func (sn *Snapshot) Get(bucketName []byte, k []byte) ([]byte, error) {
+	if err := sn.check(); err != nil {
+		return nil, err
+	}
+
+	return sn.s.Get(bucketName, k)
+}
+
+func (sn *Snapshot) MGet(bucketName []byte, keys ...[]byte) (map[string]interface{}, error) {
+	if err := sn.check(); err != nil {
+		return nil, err
+	}
+
+	return sn.s.MGet(bucketName, keys...)
+}
+
+// order by asc
+func (sn *Snapshot) List(bucketName []byte, k []byte, perpage int) ([]string, error) {
+	if err := sn.check(); err != nil {
+		return nil, err
+	}
+
+	return sn.s.List(bucketName, k, perpage)
+}
+
+// Same as Store.ForEach
+func (sn *Snapshot) ForEach(bucketName []byte, fn func(k, v []byte) error) error {
+	if err := sn.check(); err != nil {
+		return err
+	}
+
+	return sn.s.ForEach(bucketName, fn)
+}
+
+// Nothing to free, later calls return storage.ErrReleased
+func (sn *Snapshot) Release() {
+	atomic.StoreInt32(&sn.released, 1)
+}
+
+func (sn *Snapshot) check() error {
+	if atomic.LoadInt32(&sn.released) == 1 {
+		return storage.ErrReleased
+	}
+
+	return nil
+}
@@ -5,105 +5,525 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/bwmarrin/snowflake"
 	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
 
 	"github.com/akrylysov/pogreb"
 )
 
 type Store struct {
 	db         *pogreb.DB
+	dir        string
+	options    storage.Options
+	bucketMu   sync.RWMutex
 	bucketList []string
+	buckets    []string // bucket list given to NewStore
 	readOnly   bool
+	closed     int32
+	sweeper    *storage.Sweeper
+	node       *snowflake.Node
+
+	// Every call holds it shared while it uses db and index. Restore and
+	// CloseStore hold it alone to swap or close them. Taken before mu
+	dbMu sync.RWMutex
+
+	// Writes hold it from their bucket check to the pogreb write. Incr and
+	// conditional writes only share it and hold the lock of their key, so
+	// they run at once for different keys
+	mu    sync.RWMutex
+	index *keyIndex
+	locks storage.KeyLocks
 }
 
-func NewStore(bucketList []string, path string, dbFolder string, readOnly bool) (*Store, error) {
+var _ interfaces.Storage = (*Store)(nil)
+
+// Pogreb can not commit several writes as one unit. A failed batch is rolled
+// back operation by operation, which is best-effort and not crash safe
+var ErrBatchNotAtomic = errors.New("pogreb batch is not atomic, applied operations rolled back")
+
+func NewStore(bucketList []string, path string, dbFolder string, readOnly bool, opts ...storage.Option) (*Store, error) {
 	s := &Store{}
-	s.bucketList = bucketList
+	s.buckets = append([]string{}, bucketList...)
 	s.readOnly = readOnly
+	s.options = storage.NewOptions(opts...)
+	s.dir = fmt.Sprintf("%s/%s", strings.TrimSuffix(path, "/"), dbFolder)
+
+	// Insert id generator
+	node, err := snowflake.NewNode(s.options.NodeID)
+	if err != nil {
+		return s, err
+	}
+
+	s.node = node
 
 	// Create dir if not exist
 	_ = storage.CreateDir(path)
 
-	// Open DB
+	err = s.open()
+	if err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// Open DB folder, migrate it, load the bucket catalog and key index and start the sweeper
+func (s *Store) open() error {
 	db, err := pogreb.Open(
-		fmt.Sprintf("%s/%s", strings.TrimSuffix(path, "/"), dbFolder),
+		s.dir,
 		&pogreb.Options{
 			BackgroundSyncInterval: -1, // every write operation sync trigger
 		},
 	)
 	if err != nil {
-		return s, err
+		return err
 	}
 
 	s.db = db
-	return s, nil
+
+	s.bucketMu.Lock()
+	s.bucketList = append([]string{}, s.buckets...)
+
+	migrated, err := s.migrate()
+	if err == nil {
+		err = s.loadBuckets()
+	}
+	s.bucketMu.Unlock()
+
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	// Load ordered key index, rebuild it when missing, broken or keys migrated
+	s.index = newKeyIndex(fmt.Sprintf("%s/%s", s.dir, indexFile))
+
+	ok, err := s.index.load()
+	if err != nil || !ok || migrated {
+		err = s.index.rebuild(db)
+		if err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	// Saved again on CloseStore
+	if !s.readOnly {
+		err = s.index.invalidate()
+		if err != nil {
+			db.Close()
+			return err
+		}
+
+		s.sweeper = storage.NewSweeper(s.options.SweepInterval, func() {
+			_ = s.sweep()
+		})
+	}
+
+	return nil
+}
+
+// Bring the db to the current layout. Returns true when keys are rewritten
+func (s *Store) migrate() (bool, error) {
+	version, err := s.db.Get(storage.LayoutKey())
+	if err != nil {
+		return false, err
+	}
+
+	if string(version) == storage.LayoutVersion {
+		return false, nil
+	}
+
+	if s.readOnly {
+		if version != nil || s.db.Count() > 0 {
+			return false, storage.ErrLegacyLayout
+		}
+
+		return false, nil
+	}
+
+	migrated := false
+	if version == nil {
+		migrated, err = s.migrateKeys()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return migrated, s.migrateEnvelopes()
 }
 
+// Rewrite keys of the legacy "<bucket>-<key>" layout. Pogreb has no
+// transactions, so new key written before old one deleted and layout version
+// saved last. An interrupted migration runs again on next open
+func (s *Store) migrateKeys() (bool, error) {
+	// Collect first, iterator should not see the rewritten keys
+	keys, err := s.keys(func(key []byte) bool {
+		return storage.IsLegacyKey(key, s.bucketList)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, key := range keys {
+		v, err := s.db.Get(key)
+		if err != nil {
+			return false, err
+		}
+
+		bucketName, k := storage.LegacyKey(key, s.bucketList)
+
+		err = s.db.Put([]byte(storage.GenerateKey(bucketName, k)), v)
+		if err != nil {
+			return false, err
+		}
+
+		err = s.db.Delete(key)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return len(keys) > 0, s.db.Put(storage.LayoutKey(), []byte(storage.LayoutVersionKeys))
+}
+
+// Wrap values in envelopes. Wrapped values are staged in the metadata bucket
+// and a marker saved, then copied over the originals. An interrupted run
+// stages again (originals untouched) or copies again (staged values kept)
+func (s *Store) migrateEnvelopes() error {
+	marker := storage.EnvelopeKey(nil)
+
+	ok, err := s.db.Has(marker)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		keys, err := s.keys(func(key []byte) bool {
+			return !storage.IsMetaKey(key)
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			v, err := s.db.Get(key)
+			if err != nil {
+				return err
+			}
+
+			err = s.db.Put(storage.EnvelopeKey(key), storage.Wrap(v, 0))
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.db.Put(marker, []byte("1"))
+		if err != nil {
+			return err
+		}
+	}
+
+	staged, err := s.keys(func(key []byte) bool {
+		return bytes.HasPrefix(key, marker) && len(key) > len(marker)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range staged {
+		data, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+
+		err = s.db.Put(key[len(marker):], data)
+		if err != nil {
+			return err
+		}
+
+		err = s.db.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Marker removed after the version, a leftover marker is harmless
+	err = s.db.Put(storage.LayoutKey(), []byte(storage.LayoutVersion))
+	if err != nil {
+		return err
+	}
+
+	return s.db.Delete(marker)
+}
+
+// Copies of all db keys accepted by fn
+func (s *Store) keys(fn func(key []byte) bool) ([][]byte, error) {
+	keys := [][]byte{}
+
+	c := s.db.Items()
+	for {
+		key, _, err := c.Next()
+		if err == pogreb.ErrIterationDone {
+			return keys, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Iterator keys point to mmap'ed data
+		if fn(key) {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+	}
+}
+
+// Waits for running calls
 func (s *Store) CloseStore() error {
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return storage.ErrClosed
+	}
+
+	s.sweeper.Stop()
+	s.sweeper = nil
+
+	if !s.readOnly {
+		s.mu.Lock()
+		err := s.index.save()
+		s.mu.Unlock()
+
+		if err != nil {
+			s.db.Close()
+			return err
+		}
+	}
+
 	return s.db.Close()
 }
 
 // BackgroundSyncInterval option enabled. Not neccessary to call
 func (s *Store) SyncStore() {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
 	s.db.Sync()
 }
 
 func (s *Store) Set(bucketName []byte, k []byte, v []byte) ([]byte, error) {
-	if s.readOnly {
-		return nil, errors.New("readonly mod active")
-	}
+	return s.SetWithTTL(bucketName, k, v, 0)
+}
+
+// Key expires after ttl, ttl <= 0 means no expiry
+func (s *Store) SetWithTTL(bucketName []byte, k []byte, v []byte, ttl time.Duration) ([]byte, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	if err := s.checkWrite(bucketName); err != nil {
+		return nil, err
 	}
 
-	if len(k) == 0 || len(v) == 0 {
-		return nil, errors.New("key or value not found")
+	if len(k) == 0 {
+		return nil, storage.ErrEmptyKey
 	}
 
-	gkey := storage.GenerateKey(bucketName, k)
+	if len(v) == 0 {
+		return nil, storage.ErrEmptyValue
+	}
 
-	err := s.db.Put([]byte(gkey), v)
+	err := s.put(bucketName, k, storage.Wrap(v, storage.ExpireAt(ttl)))
 
 	return k, err
 }
 
-// TODO
-func (s *Store) MSet(bucketName []byte, k []byte, v []byte) ([]byte, error) {
-	return []byte(""), errors.New("not implemented")
+// Pogreb has no batch write. Items written one by one and
+// already written items rolled back (best-effort) when any write fails
+func (s *Store) MSet(bucketName []byte, items ...storage.KV) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if len(item.Key) == 0 {
+			return storage.ErrEmptyKey
+		}
+
+		if len(item.Value) == 0 {
+			return storage.ErrEmptyValue
+		}
+	}
+
+	undo := []undoItem{}
+
+	for _, item := range items {
+		u, err := s.undoItem(bucketName, []byte(item.Key))
+		if err != nil {
+			return s.rollback(undo, err)
+		}
+
+		err = s.put(bucketName, []byte(item.Key), storage.Wrap([]byte(item.Value), 0))
+		if err != nil {
+			return s.rollback(undo, err)
+		}
+
+		undo = append(undo, u)
+	}
+
+	return nil
 }
 
 func (s *Store) Get(bucketName []byte, k []byte) ([]byte, error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
 	}
 
-	gkey := storage.GenerateKey(bucketName, k)
+	return s.get(s.gkey(bucketName, k))
+}
 
-	v, err := s.db.Get([]byte(gkey))
-	if err == leveldb.ErrNotFound {
-		return v, nil
-	}
+// User value of a db key, storage.ErrNotFound for missing and expired keys
+func (s *Store) get(gkey []byte) ([]byte, error) {
+	v, _, err := s.getEnvelope(gkey)
 
 	return v, err
 }
 
-func (s *Store) MGet(bucketName []byte, keys ...[]byte) (list map[string]interface{}, err error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
+// User value and expire time of a db key, storage.ErrNotFound for missing and expired keys
+func (s *Store) getEnvelope(gkey []byte) ([]byte, int64, error) {
+	data, err := s.getRaw(gkey)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	items := make(map[string]interface{})
+	v, expireAt, err := storage.Unwrap(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if storage.Expired(expireAt) {
+		return nil, 0, storage.ErrNotFound
+	}
+
+	return v, expireAt, nil
+}
+
+// Value envelope of a db key. Pogreb returns nil value for missing keys,
+// envelopes are never empty
+func (s *Store) getRaw(gkey []byte) ([]byte, error) {
+	data, err := s.db.Get(gkey)
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		return nil, storage.ErrNotFound
+	}
+
+	return data, nil
+}
+
+// Remaining time to live of a key, storage.NoTTL for keys without expiry
+func (s *Store) TTL(bucketName []byte, k []byte) (time.Duration, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return 0, err
+	}
+
+	_, expireAt, err := s.getEnvelope(s.gkey(bucketName, k))
+	if err != nil {
+		return 0, err
+	}
+
+	return storage.Remaining(expireAt), nil
+}
+
+// Add delta to the counter of a key and return the new value. Missing key
+// counts from 0, key ttl kept. Holds the key lock, so it is atomic against
+// other writes of the key
+func (s *Store) Incr(bucketName []byte, k []byte, delta int64) (int64, error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
+	if err := s.checkWrite(bucketName); err != nil {
+		return 0, err
+	}
+
+	if len(k) == 0 {
+		return 0, storage.ErrEmptyKey
+	}
+
+	gkey := s.gkey(bucketName, k)
+
+	m := s.locks.For(gkey)
+	m.Lock()
+	defer m.Unlock()
+
+	v, expireAt, err := s.getEnvelope(gkey)
+	if err != nil && err != storage.ErrNotFound {
+		return 0, err
+	}
+
+	n, err := storage.Incr(v, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, s.put(bucketName, k, storage.Wrap(storage.U64tob(int(n)), expireAt))
+}
+
+// Same as Incr with -delta
+func (s *Store) Decr(bucketName []byte, k []byte, delta int64) (int64, error) {
+	return s.Incr(bucketName, k, -delta)
+}
+
+// Read under the store read lock and the locks of the keys, so no write
+// lands between the keys
+func (s *Store) MGet(bucketName []byte, keys ...[]byte) (list map[string]interface{}, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	gkeys := [][]byte{}
 	for _, k := range keys {
-		gkey := storage.GenerateKey(bucketName, k)
+		gkeys = append(gkeys, s.gkey(bucketName, k))
+	}
 
-		v, err := s.db.Get([]byte(gkey))
-		if err == leveldb.ErrNotFound {
-			continue
-		} else if err != nil {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	unlock := s.locks.Lock(gkeys...)
+	defer unlock()
+
+	items := make(map[string]interface{})
+
+	for i, k := range keys {
+		v, err := s.get(gkeys[i])
+		if err != nil {
 			continue
 		}
 
@@ -113,125 +533,326 @@ func (s *Store) MGet(bucketName []byte, keys ...[]byte) (list map[string]interfa
 	return items, nil
 }
 
+// order by asc
 func (s *Store) List(bucketName []byte, k []byte, perpage int) (list []string, err error) {
-	return nil, errors.New("not implemented")
+	items, err := s.ListKV(bucketName, k, perpage)
+
+	return storage.Values(items), err
 }
 
-// order by asc
+// order by desc
 func (s *Store) PrevList(bucketName []byte, k []byte, perpage int) (list []string, err error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return nil, errors.New("unknown bucket name")
-	}
+	items, err := s.PrevListKV(bucketName, k, perpage)
+
+	return storage.Values(items), err
+}
 
-	counter := 1
+// order by asc, keys with values
+func (s *Store) ListKV(bucketName []byte, k []byte, perpage int) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
 
-	items := []string{}
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
 
-	prefix := storage.GenerateKey(bucketName, nil)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	c := s.db.Items()
+	return s.values(bucketName, s.index.next(string(bucketName), string(k), perpage, s.alive(bucketName)))
+}
 
-	if len(k) > 0 {
-		gkey := storage.GenerateKey(bucketName, k)
+// order by desc, keys with values
+func (s *Store) PrevListKV(bucketName []byte, k []byte, perpage int) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
 
-		for {
-			key, val, err := c.Next()
-			if err == pogreb.ErrIterationDone {
-				err = nil
-				break
-			}
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
 
-			if !bytes.HasPrefix(key, []byte(prefix)) {
-				continue
-			}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-			if bytes.Equal([]byte(gkey), key) {
-				continue
-			}
+	return s.values(bucketName, s.index.prev(string(bucketName), string(k), perpage, s.alive(bucketName)))
+}
 
-			items = append(items, string(val))
+// Index key filter skipping expired keys
+func (s *Store) alive(bucketName []byte) func(k string) bool {
+	return func(k string) bool {
+		_, err := s.get(s.gkey(bucketName, []byte(k)))
 
-			if counter >= perpage {
-				break
-			}
+		return err == nil
+	}
+}
+
+// Values of index keys, same order
+func (s *Store) values(bucketName []byte, keys []string) ([]storage.KV, error) {
+	items := []storage.KV{}
 
-			counter++
+	for _, k := range keys {
+		v, err := s.get(s.gkey(bucketName, []byte(k)))
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
 		}
-	} else {
-		for {
-			key, val, err := c.Next()
-			if err == pogreb.ErrIterationDone {
-				err = nil
-				break
-			}
 
-			if !bytes.HasPrefix(key, []byte(prefix)) {
-				continue
-			}
+		items = append(items, storage.KV{Key: k, Value: string(v)})
+	}
 
-			items = append(items, string(val))
+	if len(items) == 0 {
+		return nil, nil
+	}
 
-			if counter >= perpage {
-				break
-			}
+	return items, nil
+}
 
-			counter++
-		}
+// order by asc, one page with cursors
+func (s *Store) ListPage(bucketName []byte, cursor string, perpage int) (*storage.Page, error) {
+	return storage.ListPage(func(k []byte, n int) ([]storage.KV, error) {
+		return s.ListKV(bucketName, k, n)
+	}, cursor, perpage)
+}
+
+// order by desc, one page with cursors
+func (s *Store) PrevListPage(bucketName []byte, cursor string, perpage int) (*storage.Page, error) {
+	return storage.ListPage(func(k []byte, n int) ([]storage.KV, error) {
+		return s.PrevListKV(bucketName, k, n)
+	}, cursor, perpage)
+}
+
+// Keys between start and end (inclusive unless opts say otherwise), via ordered key index
+func (s *Store) Range(bucketName []byte, start []byte, end []byte, opts storage.RangeOptions) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
 	}
 
-	if len(items) == 0 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.values(bucketName, s.index.scan(string(bucketName), start, end, opts, s.alive(bucketName)))
+}
+
+// Keys starting with prefix in a bucket, limit 0 means no limit
+func (s *Store) PrefixScan(bucketName []byte, prefix []byte, limit int) (list []storage.KV, err error) {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
 		return nil, err
 	}
 
-	return items, err
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.values(bucketName, s.index.prefix(string(bucketName), string(prefix), limit, s.alive(bucketName)))
+}
+
+// Call fn for every key of a bucket order by asc, without loading the bucket
+// in memory: keys are listed in chunks (storage.Walk) and no lock is held
+// while fn runs, so fn may call the store. k and v are only valid during the
+// call. fn may return storage.ErrStopIteration to stop early
+func (s *Store) ForEach(bucketName []byte, fn func(k, v []byte) error) error {
+	return storage.Walk(func(cursor []byte, n int) ([]storage.KV, error) {
+		return s.ListKV(bucketName, cursor, n)
+	}, fn)
 }
 
 func (s *Store) KeyExist(bucketName []byte, k []byte) (bool, error) {
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return false, errors.New("unknown bucket name")
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(bucketName); err != nil {
+		return false, err
 	}
 
-	gkey := storage.GenerateKey(bucketName, k)
+	_, err := s.get(s.gkey(bucketName, k))
+	if err == storage.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
 
-	return s.db.Has([]byte(gkey))
+	return true, nil
 }
 
 func (s *Store) Delete(bucketName []byte, k []byte) error {
-	if s.readOnly {
-		return errors.New("readonly mod active")
-	}
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return errors.New("unknown bucket name")
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
 	}
 
 	if len(k) == 0 {
-		return errors.New("key not found")
+		return storage.ErrEmptyKey
 	}
 
-	gkey := storage.GenerateKey(bucketName, k)
+	return s.del(bucketName, k)
+}
 
-	return s.db.Delete([]byte(gkey))
+// Pogreb write with index update, s.mu must be held (shared with the key lock)
+func (s *Store) put(bucketName []byte, k []byte, v []byte) error {
+	err := s.db.Put(s.gkey(bucketName, k), v)
+	if err != nil {
+		return err
+	}
+
+	s.index.add(string(bucketName), string(k))
+	return nil
+}
+
+// Pogreb delete with index update, s.mu must be held (shared with the key lock)
+func (s *Store) del(bucketName []byte, k []byte) error {
+	err := s.db.Delete(s.gkey(bucketName, k))
+	if err != nil {
+		return err
+	}
+
+	s.index.remove(string(bucketName), string(k))
+	return nil
+}
+
+func (s *Store) gkey(bucketName []byte, k []byte) []byte {
+	return []byte(storage.GenerateKey(bucketName, k))
+}
+
+// Pogreb has no transactions. Batch operations applied one by one and, when
+// any of them fails, already applied ones rolled back (best-effort). The
+// returned error is a *BatchError in that case
+func (s *Store) Write(batch *storage.Batch) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.checkBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	return s.write(batch)
+}
+
+// Apply a validated batch with rollback, s.mu must be held
+func (s *Store) write(batch *storage.Batch) error {
+	undo := []undoItem{}
+
+	for _, item := range batch.Items() {
+		u, err := s.undoItem(item.BucketName, item.Key)
+		if err != nil {
+			return &BatchError{Err: s.rollback(undo, err)}
+		}
+
+		if item.Op == storage.BatchDelete {
+			err = s.del(item.BucketName, item.Key)
+		} else {
+			err = s.put(item.BucketName, item.Key, storage.Wrap(item.Value, 0))
+		}
+
+		if err != nil {
+			return &BatchError{Err: s.rollback(undo, err)}
+		}
+
+		undo = append(undo, u)
+	}
+
+	return nil
+}
+
+// Validate all batch items before any write
+func (s *Store) checkBatch(batch *storage.Batch) error {
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	for _, item := range batch.Items() {
+		if err := s.checkBucket(item.BucketName); err != nil {
+			return err
+		}
+
+		if len(item.Key) == 0 {
+			return storage.ErrEmptyKey
+		}
+
+		if item.Op == storage.BatchSet && len(item.Value) == 0 {
+			return storage.ErrEmptyValue
+		}
+	}
+
+	return nil
+}
+
+// Closed store and unknown bucket check
+func (s *Store) checkBucket(bucketName []byte) error {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		return storage.ErrClosed
+	}
+
+	if len(bucketName) > 0 && !s.HasBucket(bucketName) {
+		return storage.ErrUnknownBucket
+	}
+
+	return nil
+}
+
+// Same as checkBucket, also rejects writes in readonly mod
+func (s *Store) checkWrite(bucketName []byte) error {
+	if atomic.LoadInt32(&s.closed) == 1 {
+		return storage.ErrClosed
+	}
+
+	if s.readOnly {
+		return storage.ErrReadOnly
+	}
+
+	return s.checkBucket(bucketName)
 }
 
 func (s *Store) HasBucket(bucketName []byte) bool {
+	s.bucketMu.RLock()
+	defer s.bucketMu.RUnlock()
+
 	return storage.Contains(s.bucketList, bucketName)
 }
 
 func (s *Store) ListBucket() (buckets []string, err error) {
-	return s.bucketList, nil
+	if err := s.checkBucket(nil); err != nil {
+		return nil, err
+	}
+
+	s.bucketMu.RLock()
+	defer s.bucketMu.RUnlock()
+
+	return append([]string{}, s.bucketList...), nil
 }
 
 func (s *Store) DeleteBucket(bucketName []byte) error {
-	if s.readOnly {
-		return errors.New("readonly mod active")
-	}
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
 
-	if len(bucketName) > 0 && !storage.Contains(s.bucketList, bucketName) {
-		return errors.New("unknown bucket name")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkWrite(bucketName); err != nil {
+		return err
 	}
 
+	return s.deleteBucket(bucketName)
+}
+
+// Delete all keys of a bucket, s.mu must be held
+func (s *Store) deleteBucket(bucketName []byte) error {
 	prefix := storage.GenerateKey(bucketName, nil)
+	removed := map[string]bool{}
 
 	var err error
 	var key []byte
@@ -257,15 +878,80 @@ func (s *Store) DeleteBucket(bucketName []byte) error {
 			break
 		}
 
+		removed[storage.GetRealKey(key, bucketName)] = true
+	}
+
+	// Whole bucket gone, else only the deleted keys
+	if err == nil {
+		s.index.drop(string(bucketName))
+	} else {
+		s.index.removeAll(string(bucketName), removed)
 	}
 
 	return err
 }
 
-func (s *Store) Backup(path, filename string) error {
-	return errors.New("not implemented")
+// Delete expired keys of all buckets. Expired keys are collected without the
+// lock, then checked again and deleted under the write lock, so a key set
+// again while sweeping is not deleted
+func (s *Store) sweep() error {
+	if !s.dbMu.TryRLock() {
+		return nil
+	}
+	defer s.dbMu.RUnlock()
+
+	keys, err := s.expiredKeys()
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		data, err := s.getRaw(key)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		_, expireAt, err := storage.Unwrap(data)
+		if err != nil || !storage.Expired(expireAt) {
+			continue
+		}
+
+		bucketName, k, _ := storage.ParseKey(key)
+
+		err = s.del(bucketName, k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (s *Store) Restore(path, filename string) error {
-	return errors.New("not implemented")
+// Copies of expired keys. Iterator keys point to mmap'ed data
+func (s *Store) expiredKeys() ([][]byte, error) {
+	keys := [][]byte{}
+
+	c := s.db.Items()
+	for {
+		key, value, err := c.Next()
+		if err == pogreb.ErrIterationDone {
+			return keys, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if storage.IsMetaKey(key) {
+			continue
+		}
+
+		_, expireAt, err := storage.Unwrap(value)
+		if err == nil && storage.Expired(expireAt) {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+	}
 }
@@ -2,10 +2,19 @@ package pogrebstorage
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/akrylysov/pogreb"
 	"github.com/stretchr/testify/assert"
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
 )
 
 func TestCmd(t *testing.T) {
@@ -20,8 +29,14 @@ func TestCmd(t *testing.T) {
 	assert.Equal(t, true, bytes.Equal(key, []byte("test_2")))
 	assert.NoError(t, err)
 
-	_, err = store.MSet([]byte("posts"), []byte("test_1"), []byte("number one"))
-	assert.Error(t, err)
+	err = store.MSet([]byte("posts"), storage.KV{Key: "test_1", Value: "number one"}, storage.KV{Key: "test_2", Value: "number two"})
+	assert.NoError(t, err)
+
+	err = store.MSet([]byte("posts"), storage.KV{Key: "test_3", Value: "number three"}, storage.KV{Key: "", Value: "empty"})
+	assert.ErrorIs(t, err, storage.ErrEmptyKey)
+
+	_, err = store.Set([]byte("unknown"), []byte("test_1"), []byte("number one"))
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
 
 	res, err := store.Get([]byte("posts"), []byte("test_1"))
 	assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
@@ -35,19 +50,29 @@ func TestCmd(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, items, map[string]interface{}{"test_1": "number one", "test_2": "number two"})
 
-	list, err := store.PrevList([]byte("posts"), nil, 10)
+	list, err := store.List([]byte("posts"), nil, 10)
 	assert.NoError(t, err)
 	assert.Equal(t, list, []string{"number one", "number two"})
 
-	list, err = store.PrevList([]byte("posts"), []byte("test_1"), 10)
+	list, err = store.List([]byte("posts"), []byte("test_1"), 10)
 	assert.NoError(t, err)
 	assert.Equal(t, list, []string{"number two"})
 
-	_, err = store.List([]byte("posts"), nil, 10)
-	assert.Error(t, err)
+	list, err = store.PrevList([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"number two", "number one"})
 
-	_, err = store.List([]byte("posts"), []byte("test_1"), 10)
-	assert.Error(t, err)
+	list, err = store.PrevList([]byte("posts"), []byte("test_2"), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"number one"})
+
+	kvs, err := store.ListKV([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, kvs, []storage.KV{{Key: "test_1", Value: "number one"}, {Key: "test_2", Value: "number two"}})
+
+	kvs, err = store.PrevListKV([]byte("posts"), []byte("test_2"), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, kvs, []storage.KV{{Key: "test_1", Value: "number one"}})
 
 	ok, err := store.KeyExist([]byte("posts"), []byte("test_1"))
 	assert.True(t, ok)
@@ -62,18 +87,1160 @@ func TestCmd(t *testing.T) {
 
 	res, err = store.Get([]byte("posts"), []byte("test_1"))
 	assert.Equal(t, true, bytes.Equal(res, nil))
-	assert.NoError(t, err)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	_, err = store.Get([]byte("pages"), []byte("test_1"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
 
 	err = store.DeleteBucket([]byte("posts"))
 	assert.NoError(t, err)
 
-	list, err = store.PrevList([]byte("posts"), nil, 10)
+	list, err = store.List([]byte("posts"), nil, 10)
 	assert.NoError(t, err)
 	assert.Equal(t, list, []string(nil))
 
 	err = store.CloseStore()
 	assert.NoError(t, err)
 
+	_, err = store.Get([]byte("posts"), []byte("test_2"))
+	assert.ErrorIs(t, err, storage.ErrClosed)
+
+	err = store.CloseStore()
+	assert.ErrorIs(t, err, storage.ErrClosed)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestBatch(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	batch := storage.NewBatch().
+		Delete([]byte("posts"), []byte("test_1")).
+		Set([]byte("pages"), []byte("test_1"), []byte("number one"))
+	assert.Equal(t, 2, batch.Len())
+
+	err = store.Write(batch)
+	assert.NoError(t, err)
+
+	ok, err := store.KeyExist([]byte("posts"), []byte("test_1"))
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	res, err := store.Get([]byte("pages"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+	assert.NoError(t, err)
+
+	batch = storage.NewBatch().
+		Set([]byte("posts"), []byte("test_2"), []byte("number two")).
+		Set([]byte("unknown"), []byte("test_2"), []byte("number two"))
+
+	err = store.Write(batch)
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	ok, err = store.KeyExist([]byte("posts"), []byte("test_2"))
+	assert.False(t, ok)
+	assert.NoError(t, err)
+
+	// Failed batch keeps the cause
+	err = &BatchError{Err: storage.ErrClosed}
+	assert.ErrorIs(t, err, ErrBatchNotAtomic)
+	assert.ErrorIs(t, err, storage.ErrClosed)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestIndex(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	for _, k := range []string{"test_3", "test_1", "test_2"} {
+		_, err = store.Set([]byte("posts"), []byte(k), []byte(k))
+		assert.NoError(t, err)
+	}
+
+	// Saved index file
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	store, err = OpenStore()
+	assert.NoError(t, err)
+
+	list, err := store.List([]byte("posts"), []byte("test_1"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"test_2"})
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	// Rebuilt index
+	err = os.Remove("./db/storage_test/" + indexFile)
+	assert.NoError(t, err)
+
+	store, err = OpenStore()
+	assert.NoError(t, err)
+
+	list, err = store.PrevList([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"test_3", "test_2", "test_1"})
+
+	// One key for perpage < 1, same as leveldb
+	list, err = store.List([]byte("posts"), nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"test_1"})
+
+	list, err = store.PrevList([]byte("posts"), nil, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"test_3"})
+
+	err = store.DeleteBucket([]byte("posts"))
+	assert.NoError(t, err)
+
+	list, err = store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, len(list), 0)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestPage(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	for _, k := range []string{"test_1", "test_2", "test_3"} {
+		_, err = store.Set([]byte("posts"), []byte(k), []byte(k))
+		assert.NoError(t, err)
+	}
+
+	page, err := store.ListPage([]byte("posts"), "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, page.Items, []storage.KV{{Key: "test_1", Value: "test_1"}, {Key: "test_2", Value: "test_2"}})
+	assert.True(t, page.HasMore)
+
+	page, err = store.ListPage([]byte("posts"), page.NextCursor, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, page.Items, []storage.KV{{Key: "test_3", Value: "test_3"}})
+	assert.False(t, page.HasMore)
+
+	page, err = store.PrevListPage([]byte("posts"), page.PrevCursor, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, page.Items, []storage.KV{{Key: "test_2", Value: "test_2"}, {Key: "test_1", Value: "test_1"}})
+	assert.False(t, page.HasMore)
+
+	_, err = store.ListPage([]byte("posts"), "#", 2)
+	assert.ErrorIs(t, err, storage.ErrInvalidCursor)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestRange(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		_, err = store.Set([]byte("posts"), storage.U64tob(i), []byte(fmt.Sprintf("number %d", i)))
+		assert.NoError(t, err)
+	}
+
+	_, err = store.Set([]byte("pages"), storage.U64tob(3), []byte("page 3"))
+	assert.NoError(t, err)
+
+	list, err := store.Range([]byte("posts"), storage.U64tob(2), storage.U64tob(4), storage.RangeOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(list), []string{"number 2", "number 3", "number 4"})
+
+	list, err = store.Range([]byte("posts"), storage.U64tob(2), storage.U64tob(4), storage.RangeOptions{StartExclusive: true, EndExclusive: true})
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(list), []string{"number 3"})
+
+	list, err = store.Range([]byte("posts"), nil, storage.U64tob(4), storage.RangeOptions{Reverse: true, Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(list), []string{"number 4", "number 3"})
+	assert.Equal(t, list[0].Key, string(storage.U64tob(4)))
+
+	list, err = store.Range([]byte("posts"), storage.U64tob(4), nil, storage.RangeOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(list), []string{"number 4", "number 5"})
+
+	list, err = store.Range([]byte("posts"), storage.U64tob(6), storage.U64tob(9), storage.RangeOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, list, []storage.KV(nil))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestPrefixScan(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	for _, k := range []string{"user:4:post:1", "user:42:post:7", "user:42:post:8", "user:43:post:1"} {
+		_, err = store.Set([]byte("posts"), []byte(k), []byte(k))
+		assert.NoError(t, err)
+	}
+
+	list, err := store.PrefixScan([]byte("posts"), []byte("user:42:"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []storage.KV{{Key: "user:42:post:7", Value: "user:42:post:7"}, {Key: "user:42:post:8", Value: "user:42:post:8"}})
+
+	list, err = store.PrefixScan([]byte("posts"), []byte("user:4"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Values(list), []string{"user:42:post:7", "user:42:post:8", "user:43:post:1"})
+
+	list, err = store.PrefixScan([]byte("posts"), []byte("user:5"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []storage.KV(nil))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestForEach(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		_, err = store.Set([]byte("posts"), storage.U64tob(i), []byte(fmt.Sprintf("number %d", i)))
+		assert.NoError(t, err)
+	}
+
+	items := map[uint64]string{}
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		items[storage.Btou64(k)] = string(v)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, len(items), 5)
+	assert.Equal(t, items[3], "number 3")
+
+	counter := 0
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		counter++
+		if counter == 2 {
+			return storage.ErrStopIteration
+		}
+
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, counter, 2)
+
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		return storage.ErrNotFound
+	})
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	err = store.ForEach([]byte("pages"), func(k, v []byte) error {
+		return storage.ErrNotFound
+	})
+	assert.NoError(t, err)
+
+	// Several chunks order by asc, fn may call the store
+	for i := 6; i <= 250; i++ {
+		_, err = store.Set([]byte("posts"), storage.U64tob(i), []byte(fmt.Sprintf("number %d", i)))
+		assert.NoError(t, err)
+	}
+
+	keys := []uint64{}
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		keys = append(keys, storage.Btou64(k))
+
+		_, err := store.Get([]byte("posts"), k)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, len(keys), 250)
+	assert.Equal(t, keys[0], uint64(1))
+	assert.Equal(t, keys[249], uint64(250))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestBucketPrefix(t *testing.T) {
+	store, err := NewStore([]string{"a", "a-b", "post", "post-archive"}, "./db/", "storage_test", false)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("a"), []byte("b-c"), []byte("one"))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("a-b"), []byte("c"), []byte("two"))
+	assert.NoError(t, err)
+
+	res, err := store.Get([]byte("a"), []byte("b-c"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("one")))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("post"), []byte("1"), []byte("post"))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("post-archive"), []byte("1"), []byte("archived"))
+	assert.NoError(t, err)
+
+	list, err := store.List([]byte("post"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"post"})
+
+	err = store.DeleteBucket([]byte("post"))
+	assert.NoError(t, err)
+
+	res, err = store.Get([]byte("post-archive"), []byte("1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("archived")))
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestMigrate(t *testing.T) {
+	// Legacy "<bucket>-<key>" layout
+	db, err := pogreb.Open("./db/storage_test", nil)
+	assert.NoError(t, err)
+
+	for k, v := range map[string]string{"posts-test_1": "number one", "pages-a-b": "page", "plain": "no bucket"} {
+		err = db.Put([]byte(k), []byte(v))
+		assert.NoError(t, err)
+	}
+
+	err = db.Close()
+	assert.NoError(t, err)
+
+	_, err = NewStore([]string{"options", "posts", "pages"}, "./db/", "storage_test", true)
+	assert.ErrorIs(t, err, storage.ErrLegacyLayout)
+
+	for i := 0; i < 2; i++ {
+		store, err := OpenStore()
+		assert.NoError(t, err)
+
+		res, err := store.Get([]byte("posts"), []byte("test_1"))
+		assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+		assert.NoError(t, err)
+
+		res, err = store.Get([]byte("pages"), []byte("a-b"))
+		assert.Equal(t, true, bytes.Equal(res, []byte("page")))
+		assert.NoError(t, err)
+
+		res, err = store.Get(nil, []byte("plain"))
+		assert.Equal(t, true, bytes.Equal(res, []byte("no bucket")))
+		assert.NoError(t, err)
+
+		list, err := store.List([]byte("pages"), nil, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, list, []string{"page"})
+
+		err = store.CloseStore()
+		assert.NoError(t, err)
+	}
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestBuckets(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	err = store.CreateBucket([]byte("drafts"))
+	assert.NoError(t, err)
+
+	err = store.CreateBucket([]byte("drafts"))
+	assert.NoError(t, err)
+
+	err = store.CreateBucket(storage.MetaBucket)
+	assert.ErrorIs(t, err, storage.ErrInvalidBucket)
+
+	err = store.CreateBucket(nil)
+	assert.ErrorIs(t, err, storage.ErrInvalidBucket)
+
+	_, err = store.Set([]byte("drafts"), []byte("draft_1"), []byte("draft"))
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	store, err = NewStore([]string{"options"}, "./db/", "storage_test", false)
+	assert.NoError(t, err)
+
+	assert.Equal(t, store.HasBucket([]byte("drafts")), true)
+	assert.Equal(t, store.HasBucket([]byte("posts")), true)
+	assert.Equal(t, store.HasBucket(storage.MetaBucket), false)
+
+	res, err := store.Get([]byte("drafts"), []byte("draft_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("draft")))
+	assert.NoError(t, err)
+
+	err = store.DropBucket([]byte("drafts"))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("drafts"), []byte("draft_2"), []byte("draft"))
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	err = store.DropBucket([]byte("drafts"))
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	// Created again empty
+	err = store.CreateBucket([]byte("drafts"))
+	assert.NoError(t, err)
+
+	_, err = store.Get([]byte("drafts"), []byte("draft_1"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	err = store.DropBucket([]byte("drafts"))
+	assert.NoError(t, err)
+
+	// Writes racing the drop do not show up in the bucket created again
+	for i := 0; i < 20; i++ {
+		err = store.CreateBucket([]byte("drafts"))
+		assert.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+
+				for n := 0; ; n++ {
+					_, err := store.Set([]byte("drafts"), []byte(fmt.Sprintf("draft_%d_%d", j, n)), []byte("draft"))
+					if err != nil {
+						assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+						return
+					}
+				}
+			}(j)
+		}
+
+		time.Sleep(time.Millisecond)
+
+		err = store.DropBucket([]byte("drafts"))
+		assert.NoError(t, err)
+
+		wg.Wait()
+
+		err = store.CreateBucket([]byte("drafts"))
+		assert.NoError(t, err)
+
+		list, err := store.ListKV([]byte("drafts"), nil, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, list)
+
+		err = store.DropBucket([]byte("drafts"))
+		assert.NoError(t, err)
+	}
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	store, err = OpenStore()
+	assert.NoError(t, err)
+
+	assert.Equal(t, store.HasBucket([]byte("drafts")), false)
+
+	buckets, err := store.ListBucket()
+	assert.NoError(t, err)
+	assert.Equal(t, buckets, []string{"options", "posts", "pages"})
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestMigrateEnvelope(t *testing.T) {
+	// Layout version 2, values without envelope
+	db, err := pogreb.Open("./db/storage_test", nil)
+	assert.NoError(t, err)
+
+	err = db.Put([]byte(storage.GenerateKey([]byte("posts"), []byte("test_1"))), []byte("number one"))
+	assert.NoError(t, err)
+
+	err = db.Put(storage.LayoutKey(), []byte(storage.LayoutVersionKeys))
+	assert.NoError(t, err)
+
+	err = db.Close()
+	assert.NoError(t, err)
+
+	_, err = NewStore([]string{"options", "posts", "pages"}, "./db/", "storage_test", true)
+	assert.ErrorIs(t, err, storage.ErrLegacyLayout)
+
+	for i := 0; i < 2; i++ {
+		store, err := OpenStore()
+		assert.NoError(t, err)
+
+		res, err := store.Get([]byte("posts"), []byte("test_1"))
+		assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+		assert.NoError(t, err)
+
+		ttl, err := store.TTL([]byte("posts"), []byte("test_1"))
+		assert.NoError(t, err)
+		assert.Equal(t, ttl, storage.NoTTL)
+
+		err = store.CloseStore()
+		assert.NoError(t, err)
+	}
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestTTL(t *testing.T) {
+	store, err := NewStore([]string{"options", "posts", "pages"}, "./db/", "storage_test", false, storage.WithSweepInterval(10*time.Millisecond))
+	assert.NoError(t, err)
+
+	_, err = store.SetWithTTL([]byte("posts"), []byte("test_1"), []byte("number one"), 50*time.Millisecond)
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_2"), []byte("number two"))
+	assert.NoError(t, err)
+
+	ttl, err := store.TTL([]byte("posts"), []byte("test_1"))
+	assert.NoError(t, err)
+	assert.Equal(t, ttl > 0 && ttl <= 50*time.Millisecond, true)
+
+	ttl, err = store.TTL([]byte("posts"), []byte("test_2"))
+	assert.NoError(t, err)
+	assert.Equal(t, ttl, storage.NoTTL)
+
+	_, err = store.TTL([]byte("posts"), []byte("test_3"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	res, err := store.Get([]byte("posts"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+	assert.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = store.Get([]byte("posts"), []byte("test_1"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	_, err = store.TTL([]byte("posts"), []byte("test_1"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	ok, err := store.KeyExist([]byte("posts"), []byte("test_1"))
+	assert.NoError(t, err)
+	assert.Equal(t, ok, false)
+
+	items, err := store.MGet([]byte("posts"), []byte("test_1"), []byte("test_2"))
+	assert.NoError(t, err)
+	assert.Equal(t, items, map[string]interface{}{"test_2": "number two"})
+
+	list, err := store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"number two"})
+
+	list, err = store.PrevList([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"number two"})
+
+	// Deleted by the sweeper
+	ok, err = store.db.Has([]byte(storage.GenerateKey([]byte("posts"), []byte("test_1"))))
+	assert.NoError(t, err)
+	assert.Equal(t, ok, false)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestIncr(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				_, err := store.Incr([]byte("posts"), []byte("views"), 2)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	n, err := store.Decr([]byte("posts"), []byte("views"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, n, int64(999))
+
+	res, err := store.Get([]byte("posts"), []byte("views"))
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Btou64(res), uint64(999))
+
+	// Counters of different keys run at once, new keys enter the index
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				_, err := store.Incr([]byte("pages"), []byte(fmt.Sprintf("page_%d", j)), 1)
+				assert.NoError(t, err)
+
+				_, err = store.List([]byte("pages"), nil, 5)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	items, err := store.ListKV([]byte("pages"), nil, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, len(items), 20)
+
+	res, err = store.Get([]byte("pages"), []byte("page_19"))
+	assert.NoError(t, err)
+	assert.Equal(t, storage.Btou64(res), uint64(10))
+
+	n, err = store.Decr([]byte("posts"), []byte("likes"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, n, int64(-3))
+
+	n, err = store.Incr([]byte("posts"), []byte("likes"), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, n, int64(2))
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	_, err = store.Incr([]byte("posts"), []byte("test_1"), 1)
+	assert.ErrorIs(t, err, storage.ErrInvalidCounter)
+
+	_, err = store.Incr([]byte("unknown"), []byte("views"), 1)
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestConditional(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	err = store.SetIfAbsent([]byte("posts"), []byte("doc"), []byte("v1"))
+	assert.NoError(t, err)
+
+	err = store.SetIfAbsent([]byte("posts"), []byte("doc"), []byte("v2"))
+	assert.ErrorIs(t, err, storage.ErrConflict)
+
+	var conflict *storage.ConflictError
+	err = store.CompareAndSwap([]byte("posts"), []byte("doc"), []byte("v0"), []byte("v2"))
+	assert.Equal(t, errors.As(err, &conflict), true)
+	assert.Equal(t, conflict.Current, []byte("v1"))
+
+	err = store.CompareAndSwap([]byte("posts"), []byte("doc"), []byte("v1"), []byte("v2"))
+	assert.NoError(t, err)
+
+	res, err := store.Get([]byte("posts"), []byte("doc"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("v2")))
+	assert.NoError(t, err)
+
+	err = store.CompareAndSwap([]byte("posts"), []byte("missing"), []byte("v1"), []byte("v2"))
+	assert.Equal(t, errors.As(err, &conflict), true)
+	assert.Nil(t, conflict.Current)
+
+	err = store.DeleteIfEquals([]byte("posts"), []byte("doc"), []byte("v1"))
+	assert.ErrorIs(t, err, storage.ErrConflict)
+
+	err = store.DeleteIfEquals([]byte("posts"), []byte("doc"), []byte("v2"))
+	assert.NoError(t, err)
+
+	_, err = store.Get([]byte("posts"), []byte("doc"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Concurrent read-modify-write loops do not lose updates
+	err = store.SetIfAbsent([]byte("posts"), []byte("count"), []byte("0"))
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				res, err := store.Get([]byte("posts"), []byte("count"))
+				assert.NoError(t, err)
+
+				n, _ := strconv.Atoi(string(res))
+				err = store.CompareAndSwap([]byte("posts"), []byte("count"), res, []byte(strconv.Itoa(n+1)))
+				if !errors.Is(err, storage.ErrConflict) {
+					assert.NoError(t, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	res, err = store.Get([]byte("posts"), []byte("count"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("10")))
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestSequence(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	for i, v := range []string{"first", "second", "third"} {
+		seq, err := store.Append([]byte("posts"), []byte(v))
+		assert.NoError(t, err)
+		assert.Equal(t, seq, uint64(i+1))
+	}
+
+	list, err := store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"first", "second", "third"})
+
+	seq, err := store.NextSequence([]byte("posts"))
+	assert.NoError(t, err)
+	assert.Equal(t, seq, uint64(4))
+
+	seq, err = store.NextSequence([]byte("pages"))
+	assert.NoError(t, err)
+	assert.Equal(t, seq, uint64(1))
+
+	_, err = store.NextSequence([]byte("unknown"))
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	store, err = OpenStore()
+	assert.NoError(t, err)
+
+	seq, err = store.NextSequence([]byte("posts"))
+	assert.NoError(t, err)
+	assert.Equal(t, seq, uint64(5))
+
+	err = store.CreateBucket([]byte("logs"))
+	assert.NoError(t, err)
+
+	_, err = store.Append([]byte("logs"), []byte("log"))
+	assert.NoError(t, err)
+
+	err = store.DropBucket([]byte("logs"))
+	assert.NoError(t, err)
+
+	err = store.CreateBucket([]byte("logs"))
+	assert.NoError(t, err)
+
+	seq, err = store.NextSequence([]byte("logs"))
+	assert.NoError(t, err)
+	assert.Equal(t, seq, uint64(1))
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestInsert(t *testing.T) {
+	_, err := NewStore([]string{"options", "posts", "pages"}, "./db/", "storage_test", false, storage.WithNodeID(2048))
+	assert.Error(t, err)
+
+	store, err := NewStore([]string{"options", "posts", "pages"}, "./db/", "storage_test", false, storage.WithNodeID(7))
+	assert.NoError(t, err)
+
+	ids := []int64{}
+	for _, v := range []string{"first", "second", "third"} {
+		id, err := store.Insert([]byte("posts"), []byte(v))
+		assert.NoError(t, err)
+
+		ids = append(ids, id)
+	}
+
+	assert.Equal(t, ids[0] < ids[1] && ids[1] < ids[2], true)
+
+	res, err := store.Get([]byte("posts"), storage.U64tob(int(ids[1])))
+	assert.Equal(t, true, bytes.Equal(res, []byte("second")))
+	assert.NoError(t, err)
+
+	list, err := store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"first", "second", "third"})
+
+	_, err = store.Insert([]byte("unknown"), []byte("value"))
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestSnapshot(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	err = store.MSet([]byte("posts"), storage.KV{Key: "test_1", Value: "one"}, storage.KV{Key: "test_2", Value: "two"})
+	assert.NoError(t, err)
+
+	snap, err := store.Snapshot()
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("changed"))
+	assert.NoError(t, err)
+
+	err = store.Delete([]byte("posts"), []byte("test_2"))
+	assert.NoError(t, err)
+
+	// Best-effort, writes after Snapshot are visible
+	res, err := snap.Get([]byte("posts"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("changed")))
+	assert.NoError(t, err)
+
+	list, err := snap.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"changed"})
+
+	snap.Release()
+	snap.Release()
+
+	_, err = snap.Get([]byte("posts"), []byte("test_1"))
+	assert.ErrorIs(t, err, storage.ErrReleased)
+
+	res, err = store.Get([]byte("posts"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("changed")))
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestTx(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("one"))
+	assert.NoError(t, err)
+
+	// Move a key between buckets as one unit
+	err = store.Update(func(tx interfaces.Tx) error {
+		v, err := tx.Get([]byte("posts"), []byte("test_1"))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Set([]byte("pages"), []byte("test_1"), v)
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete([]byte("posts"), []byte("test_1"))
+	})
+	assert.NoError(t, err)
+
+	res, err := store.Get([]byte("pages"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("one")))
+	assert.NoError(t, err)
+
+	_, err = store.Get([]byte("posts"), []byte("test_1"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	// Failed closure writes nothing
+	errAbort := errors.New("abort")
+	err = store.Update(func(tx interfaces.Tx) error {
+		err := tx.Set([]byte("posts"), []byte("test_2"), []byte("two"))
+		assert.NoError(t, err)
+
+		return errAbort
+	})
+	assert.ErrorIs(t, err, errAbort)
+
+	_, err = store.Get([]byte("posts"), []byte("test_2"))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	err = store.Update(func(tx interfaces.Tx) error {
+		return tx.Set([]byte("unknown"), []byte("test_2"), []byte("two"))
+	})
+	assert.ErrorIs(t, err, storage.ErrUnknownBucket)
+
+	// Reads see the buffered writes
+	err = store.Update(func(tx interfaces.Tx) error {
+		err := tx.Set([]byte("pages"), []byte("test_2"), []byte("two"))
+		assert.NoError(t, err)
+
+		res, err := tx.Get([]byte("pages"), []byte("test_2"))
+		assert.Equal(t, true, bytes.Equal(res, []byte("two")))
+		assert.NoError(t, err)
+
+		list, err := tx.List([]byte("pages"), nil, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, list, []string{"one", "two"})
+
+		err = tx.Delete([]byte("pages"), []byte("test_1"))
+		assert.NoError(t, err)
+
+		_, err = tx.Get([]byte("pages"), []byte("test_1"))
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		list, err = tx.List([]byte("pages"), nil, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, list, []string{"two"})
+
+		return errAbort
+	})
+	assert.ErrorIs(t, err, errAbort)
+
+	// Buffered writes keep their own copy of reused slices
+	err = store.Update(func(tx interfaces.Tx) error {
+		k := []byte("test_3")
+		v := []byte("three")
+
+		err := tx.Set([]byte("pages"), k, v)
+		assert.NoError(t, err)
+
+		copy(k, "test_4")
+		copy(v, "fours")
+
+		res, err := tx.Get([]byte("pages"), []byte("test_3"))
+		assert.Equal(t, true, bytes.Equal(res, []byte("three")))
+		assert.NoError(t, err)
+
+		return errAbort
+	})
+	assert.ErrorIs(t, err, errAbort)
+
+	err = store.View(func(tx interfaces.Tx) error {
+		res, err := tx.Get([]byte("pages"), []byte("test_1"))
+		assert.Equal(t, true, bytes.Equal(res, []byte("one")))
+		assert.NoError(t, err)
+
+		list, err := tx.List([]byte("pages"), nil, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, list, []string{"one"})
+
+		return tx.Set([]byte("pages"), []byte("test_2"), []byte("two"))
+	})
+	assert.ErrorIs(t, err, storage.ErrReadOnly)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+}
+
+func TestBackup(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	err = store.CreateBucket([]byte("comments"))
+	assert.NoError(t, err)
+
+	for _, k := range []string{"test_2", "test_1"} {
+		_, err = store.Set([]byte("posts"), []byte(k), []byte(k))
+		assert.NoError(t, err)
+	}
+
+	_, err = store.SetWithTTL([]byte("comments"), []byte("test_1"), []byte("comment one"), time.Hour)
+	assert.NoError(t, err)
+
+	err = store.Backup("./db/backup", "pogreb.bak")
+	assert.NoError(t, err)
+
+	// Changes after backup are lost on restore
+	_, err = store.Set([]byte("posts"), []byte("test_3"), []byte("test_3"))
+	assert.NoError(t, err)
+
+	err = store.Delete([]byte("posts"), []byte("test_1"))
+	assert.NoError(t, err)
+
+	err = store.DropBucket([]byte("comments"))
+	assert.NoError(t, err)
+
+	// Calls keep working while restoring
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			_, err := store.Get([]byte("posts"), []byte("test_2"))
+			assert.NoError(t, err)
+
+			_, err = store.Set([]byte("options"), []byte("test_1"), []byte("test_1"))
+			assert.NoError(t, err)
+		}
+	}()
+
+	err = store.Restore("./db/backup", "pogreb.bak")
+	assert.NoError(t, err)
+
+	<-done
+
+	list, err := store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"test_1", "test_2"})
+
+	assert.Equal(t, store.HasBucket([]byte("comments")), true)
+
+	res, err := store.Get([]byte("comments"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("comment one")))
+	assert.NoError(t, err)
+
+	ttl, err := store.TTL([]byte("comments"), []byte("test_1"))
+	assert.NoError(t, err)
+	assert.Equal(t, ttl > 0 && ttl <= time.Hour, true)
+
+	// Store still writable after restore
+	_, err = store.Set([]byte("posts"), []byte("test_3"), []byte("test_3"))
+	assert.NoError(t, err)
+
+	err = os.WriteFile("./db/backup/invalid.bak", []byte("invalid"), 0644)
+	assert.NoError(t, err)
+
+	err = store.Restore("./db/backup", "invalid.bak")
+	assert.ErrorIs(t, err, storage.ErrInvalidArchive)
+
+	list, err = store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"test_1", "test_2", "test_3"})
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	// Restored db and index reopen
+	store, err = OpenStore()
+	assert.NoError(t, err)
+
+	list, err = store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"test_1", "test_2", "test_3"})
+
+	// ForEach callbacks may call the store while a Restore waits for the swap
+	restored := make(chan error, 1)
+	started := false
+	err = store.ForEach([]byte("posts"), func(k, v []byte) error {
+		if !started {
+			started = true
+
+			go func() {
+				restored <- store.Restore("./db/backup", "pogreb.bak")
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		_, err := store.KeyExist([]byte("posts"), k)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, <-restored)
+
+	list, err = store.List([]byte("posts"), nil, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, list, []string{"test_1", "test_2"})
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+
+	err = os.RemoveAll("./db/backup")
+	assert.NoError(t, err)
+}
+
+func TestDump(t *testing.T) {
+	store, err := OpenStore()
+	assert.NoError(t, err)
+
+	err = store.CreateBucket([]byte("comments"))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), []byte("test_1"), []byte("number one"))
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("posts"), storage.U64tob(2), []byte{0, 1, 255})
+	assert.NoError(t, err)
+
+	_, err = store.Set([]byte("comments"), []byte("test_1"), []byte("comment one"))
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	err = storage.Dump(&buf, store)
+	assert.NoError(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
+	err = DeleteStore()
+	assert.NoError(t, err)
+
+	// Missing buckets created on load
+	store, err = NewStore([]string{"options"}, "./db/", "storage_test", false)
+	assert.NoError(t, err)
+
+	err = storage.Load(&buf, store)
+	assert.NoError(t, err)
+
+	assert.Equal(t, store.HasBucket([]byte("posts")), true)
+	assert.Equal(t, store.HasBucket([]byte("comments")), true)
+
+	res, err := store.Get([]byte("posts"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("number one")))
+	assert.NoError(t, err)
+
+	res, err = store.Get([]byte("posts"), storage.U64tob(2))
+	assert.Equal(t, true, bytes.Equal(res, []byte{0, 1, 255}))
+	assert.NoError(t, err)
+
+	res, err = store.Get([]byte("comments"), []byte("test_1"))
+	assert.Equal(t, true, bytes.Equal(res, []byte("comment one")))
+	assert.NoError(t, err)
+
+	err = storage.Load(strings.NewReader(`{"bucket":"posts","key":"!","value":"dmFsdWU="}`), store)
+	assert.Error(t, err)
+
+	err = store.CloseStore()
+	assert.NoError(t, err)
+
 	err = DeleteStore()
 	assert.NoError(t, err)
 }
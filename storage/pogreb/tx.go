@@ -0,0 +1,191 @@
+package pogrebstorage
+
+import (
+	"github.com/uretgec/mylsmdb/storage"
+	"github.com/uretgec/mylsmdb/storage/interfaces"
+)
+
+// Store view inside Update and View. Pogreb has no transactions: Update holds
+// the store lock and buffers writes in a batch, applied (with rollback, see
+// Write) when fn returns nil. Reads see the buffered writes
+type Tx struct {
+	s     *Store
+	batch *storage.Batch // nil in View
+
+	// Last buffered write of every key, by bucket
+	writes map[string]map[string]storage.BatchItem
+}
+
+var _ interfaces.Tx = (*Tx)(nil)
+
+// Run fn under the store write lock and apply its writes as one batch when
+// it returns nil. fn must only use tx, store writes wait for the lock
+func (s *Store) Update(fn func(tx interfaces.Tx) error) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkWrite(nil); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &Tx{s: s, batch: storage.NewBatch(), writes: map[string]map[string]storage.BatchItem{}}
+
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return s.write(tx.batch)
+}
+
+// Run fn under the store read lock, writes return storage.ErrReadOnly
+func (s *Store) View(fn func(tx interfaces.Tx) error) error {
+	s.dbMu.RLock()
+	defer s.dbMu.RUnlock()
+
+	if err := s.checkBucket(nil); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&Tx{s: s})
+}
+
+func (tx *Tx) Get(bucketName []byte, k []byte) ([]byte, error) {
+	if err := tx.s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	return tx.get(bucketName, k, tx.buffered(bucketName))
+}
+
+// Buffered value of a key when written in tx, else the stored one
+func (tx *Tx) get(bucketName []byte, k []byte, buffered map[string]storage.BatchItem) ([]byte, error) {
+	item, ok := buffered[string(k)]
+	if !ok {
+		return tx.s.get(tx.s.gkey(bucketName, k))
+	}
+
+	if item.Op == storage.BatchDelete {
+		return nil, storage.ErrNotFound
+	}
+
+	return item.Value, nil
+}
+
+// Last buffered write of every key of a bucket, nil in View
+func (tx *Tx) buffered(bucketName []byte) map[string]storage.BatchItem {
+	return tx.writes[string(bucketName)]
+}
+
+// Buffer a write with copies of its slices, fn may reuse them
+func (tx *Tx) buffer(op int, bucketName []byte, k []byte, v []byte) {
+	item := storage.BatchItem{
+		Op:         op,
+		BucketName: append([]byte{}, bucketName...),
+		Key:        append([]byte{}, k...),
+	}
+
+	if op == storage.BatchSet {
+		item.Value = append([]byte{}, v...)
+		tx.batch.Set(item.BucketName, item.Key, item.Value)
+	} else {
+		tx.batch.Delete(item.BucketName, item.Key)
+	}
+
+	items, ok := tx.writes[string(bucketName)]
+	if !ok {
+		items = map[string]storage.BatchItem{}
+		tx.writes[string(bucketName)] = items
+	}
+
+	items[string(k)] = item
+}
+
+func (tx *Tx) Set(bucketName []byte, k []byte, v []byte) error {
+	if err := tx.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	if len(v) == 0 {
+		return storage.ErrEmptyValue
+	}
+
+	tx.buffer(storage.BatchSet, bucketName, k, v)
+	return nil
+}
+
+func (tx *Tx) Delete(bucketName []byte, k []byte) error {
+	if err := tx.checkWrite(bucketName); err != nil {
+		return err
+	}
+
+	if len(k) == 0 {
+		return storage.ErrEmptyKey
+	}
+
+	tx.buffer(storage.BatchDelete, bucketName, k, nil)
+	return nil
+}
+
+// order by asc, store lock already held. Buffered keys merged into the index keys
+func (tx *Tx) List(bucketName []byte, k []byte, perpage int) ([]string, error) {
+	if err := tx.s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	buffered := tx.buffered(bucketName)
+
+	idx := tx.s.index
+	if len(buffered) > 0 {
+		idx = newKeyIndex("")
+		idx.buckets[string(bucketName)] = tx.s.index.keys(string(bucketName))
+
+		for key, item := range buffered {
+			if item.Op == storage.BatchSet {
+				idx.add(string(bucketName), key)
+			}
+		}
+	}
+
+	keys := idx.next(string(bucketName), string(k), perpage, func(key string) bool {
+		_, err := tx.get(bucketName, []byte(key), buffered)
+
+		return err == nil
+	})
+
+	list := []string{}
+	for _, key := range keys {
+		v, err := tx.get(bucketName, []byte(key), buffered)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		list = append(list, string(v))
+	}
+
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	return list, nil
+}
+
+func (tx *Tx) checkWrite(bucketName []byte) error {
+	if tx.batch == nil {
+		return storage.ErrReadOnly
+	}
+
+	return tx.s.checkWrite(bucketName)
+}
@@ -0,0 +1,36 @@
+package storage
+
+import "bytes"
+
+// Options of a bounded range scan. Bounds are inclusive by default,
+// empty start or end means the bucket beginning or end
+type RangeOptions struct {
+	StartExclusive bool
+	EndExclusive   bool
+	Limit          int  // 0 means no limit
+	Reverse        bool // order by desc
+}
+
+// Check key against range bounds
+func (o RangeOptions) InRange(k, start, end []byte) bool {
+	if len(start) > 0 {
+		c := bytes.Compare(k, start)
+		if c < 0 || (c == 0 && o.StartExclusive) {
+			return false
+		}
+	}
+
+	if len(end) > 0 {
+		c := bytes.Compare(k, end)
+		if c > 0 || (c == 0 && o.EndExclusive) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Limit reached check
+func (o RangeOptions) Full(count int) bool {
+	return o.Limit > 0 && count >= o.Limit
+}
@@ -0,0 +1,49 @@
+package storage
+
+import "time"
+
+// Background goroutine calling fn every interval until Stop
+type Sweeper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start a sweeper. Returns nil (a valid, stopped sweeper) for interval <= 0
+func NewSweeper(interval time.Duration, fn func()) *Sweeper {
+	if interval <= 0 {
+		return nil
+	}
+
+	sw := &Sweeper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(sw.done)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-sw.stop:
+				return
+			case <-t.C:
+				fn()
+			}
+		}
+	}()
+
+	return sw
+}
+
+// Stop the goroutine and wait for a running fn to return
+func (sw *Sweeper) Stop() {
+	if sw == nil {
+		return
+	}
+
+	close(sw.stop)
+	<-sw.done
+}
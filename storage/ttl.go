@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Returned by TTL for keys without expiry
+const NoTTL time.Duration = -1
+
+// Leveldb and pogreb values are saved in an envelope: 8 byte big endian
+// expire time (unix nano, 0 means no expiry) followed by the user value
+const envelopeSize = 8
+
+// Expire time of a ttl from now, 0 (no expiry) for ttl <= 0
+func ExpireAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// Expire time check, 0 never expires
+func Expired(expireAt int64) bool {
+	return expireAt > 0 && time.Now().UnixNano() >= expireAt
+}
+
+// Remaining time of an expire time, NoTTL for 0
+func Remaining(expireAt int64) time.Duration {
+	if expireAt == 0 {
+		return NoTTL
+	}
+
+	d := time.Until(time.Unix(0, expireAt))
+	if d < 0 {
+		return 0
+	}
+
+	return d
+}
+
+// Value with envelope
+func Wrap(v []byte, expireAt int64) []byte {
+	data := make([]byte, envelopeSize+len(v))
+	binary.BigEndian.PutUint64(data, uint64(expireAt))
+	copy(data[envelopeSize:], v)
+
+	return data
+}
+
+// Value and expire time of an envelope. v shares memory with data
+func Unwrap(data []byte) (v []byte, expireAt int64, err error) {
+	if len(data) < envelopeSize {
+		return nil, 0, ErrInvalidEnvelope
+	}
+
+	return data[envelopeSize:], int64(binary.BigEndian.Uint64(data)), nil
+}
+
+// Same as Unwrap, returns ErrNotFound for expired values
+func Live(data []byte) ([]byte, error) {
+	v, expireAt, err := Unwrap(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if Expired(expireAt) {
+		return nil, ErrNotFound
+	}
+
+	return v, nil
+}
@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -30,6 +32,18 @@ func Contains(s []string, str []byte) bool {
 	return false
 }
 
+// Usage: Bucket list update, returns a new slice without str
+func Remove(s []string, str []byte) []string {
+	list := make([]string, 0, len(s))
+	for _, v := range s {
+		if v != string(str) {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
 // Usage: for boltdb db storage folder
 func CreateDir(path string) error {
 	// Check if folder exists
@@ -56,17 +70,53 @@ func DeleteFileOrDirectory(path string) error {
 	return nil
 }
 
-// Generate Key with bucketName
-// TODO: bucketName and k may be nil and check check check lots of time
-func GenerateKey(bucketName, k []byte) string {
-	if len(bucketName) == 0 {
-		return string(k)
+// Replace dir with newDir. The old dir is moved aside first and put back
+// when newDir can not be moved, then removed
+func SwapDir(dir, newDir string) error {
+	old := dir + ".old"
+
+	err := os.RemoveAll(old)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(dir, old)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
 
-	return fmt.Sprintf("%s-%s", bucketName, k)
+	err = os.Rename(newDir, dir)
+	if err != nil {
+		_ = os.Rename(old, dir)
+		return err
+	}
+
+	return os.RemoveAll(old)
+}
+
+// Generate Key with bucketName. Bucket name is length prefixed
+// ("<len>:<bucket><key>"), so bucket "a" key "b-c" and bucket "a-b" key "c"
+// never collide and prefix of a bucket never matches another bucket
+func GenerateKey(bucketName, k []byte) string {
+	return fmt.Sprintf("%d:%s%s", len(bucketName), bucketName, k)
 }
 
 // Find real key
 func GetRealKey(dbkey, bucketName []byte) string {
 	return strings.TrimPrefix(string(dbkey), GenerateKey(bucketName, nil))
 }
+
+// Split a GenerateKey key into bucket name and real key
+func ParseKey(dbkey []byte) (bucketName []byte, k []byte, ok bool) {
+	i := bytes.IndexByte(dbkey, ':')
+	if i < 1 {
+		return nil, nil, false
+	}
+
+	n, err := strconv.Atoi(string(dbkey[:i]))
+	if err != nil || n < 0 || len(dbkey) < i+1+n {
+		return nil, nil, false
+	}
+
+	return dbkey[i+1 : i+1+n], dbkey[i+1+n:], true
+}